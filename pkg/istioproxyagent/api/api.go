@@ -0,0 +1,104 @@
+package api
+
+import (
+	"time"
+
+	meshconfig "istio.io/api/mesh/v1alpha1"
+)
+
+// StartRequest is sent by the CNI/injection webhook path to ask the agent
+// to start the istio-proxy sidecar for a pod that was created without it.
+type StartRequest struct {
+	PodName         string
+	PodNamespace    string
+	PodUID          string
+	PodIP           string
+	PodSandboxID    string
+	PodJSON         string
+	SidecarTemplate string
+	MeshConfig      *meshconfig.MeshConfig
+	SecretData      map[string][]byte
+
+	// ImagePullSecrets lists the names of the pod's imagePullSecrets, so
+	// the agent can resolve credentials for private sidecar images.
+	ImagePullSecrets []string
+}
+
+// StopRequest asks the agent to stop the istio-proxy sidecar belonging
+// to a pod. The stopped container is not removed.
+type StopRequest struct {
+	PodName      string
+	PodNamespace string
+	PodUID       string
+	PodSandboxID string
+}
+
+// ReadinessRequest asks the agent to check whether a pod's istio-proxy
+// sidecar has become ready.
+type ReadinessRequest struct {
+	PodName      string
+	PodNamespace string
+	PodUID       string
+	PodIP        string
+	NetNS        string
+
+	// PodJSON and SidecarTemplate let the agent re-derive the sidecar's
+	// own ReadinessProbe from the injection spec (see getSidecar) when
+	// the fields below don't override it. Both are optional; if either
+	// is empty the agent falls back to its built-in defaults.
+	PodJSON         string
+	SidecarTemplate string
+	MeshConfig      *meshconfig.MeshConfig
+
+	// The fields below, if set, take precedence over the sidecar's own
+	// ReadinessProbe and the agent's defaults.
+	ProbeType         string // "http" (default) or "tcpSocket"
+	Scheme            string // "http" or "https"
+	Host              string
+	Port              int32
+	Path              string
+	Headers           map[string]string
+	ExpectedStatusMin int
+	ExpectedStatusMax int
+	TimeoutSeconds    float64
+	PeriodSeconds     float64
+	CABundle          []byte
+	ServerName        string
+}
+
+// InfoResponse is the body of GET /info on the agent's diagnostics API.
+type InfoResponse struct {
+	Version           string  `json:"version"`
+	RuntimeEndpoint   string  `json:"runtimeEndpoint"`
+	RuntimeAPIVersion string  `json:"runtimeApiVersion"`
+	GOOS              string  `json:"goos"`
+	UptimeSeconds     float64 `json:"uptimeSeconds"`
+	ProxiesStarted    int64   `json:"proxiesStarted"`
+	ProxiesStopped    int64   `json:"proxiesStopped"`
+	ProxiesFailed     int64   `json:"proxiesFailed"`
+}
+
+// ProxySummary is one entry of GET /proxies.
+type ProxySummary struct {
+	PodUID        string     `json:"podUID"`
+	PodName       string     `json:"podName"`
+	PodNamespace  string     `json:"podNamespace"`
+	PodSandboxID  string     `json:"podSandboxID"`
+	ContainerID   string     `json:"containerID"`
+	Image         string     `json:"image"`
+	State         string     `json:"state"`
+	LastError     string     `json:"lastError,omitempty"`
+	LastReady     *bool      `json:"lastReady,omitempty"`
+	LastCheckedAt *time.Time `json:"lastCheckedAt,omitempty"`
+	LastLatencyMs *int64     `json:"lastLatencyMs,omitempty"`
+}
+
+// ProxyDetail is the body of GET /proxies/{podUID}: the summary plus the
+// runtime's container status and a tail of the sidecar's logs.
+type ProxyDetail struct {
+	ProxySummary
+	ContainerState string   `json:"containerState"`
+	ExitCode       int32    `json:"exitCode"`
+	Reason         string   `json:"reason,omitempty"`
+	Logs           []string `json:"logs"`
+}
@@ -0,0 +1,101 @@
+package api
+
+// The types below are a version-neutral subset of the CRI runtime API.
+// server.CRIRuntime builds values of these types and relies on a
+// runtime-internal adapter to translate them to/from whichever CRI
+// dialect (v1 or v1alpha2) the container runtime actually speaks.
+// They live here, rather than in the server package, so that
+// pkg/istioproxyagent/kube can assemble a ContainerConfig directly from
+// a Kubernetes pod manifest without an import cycle back to server.
+
+type ImageSpec struct {
+	Image string
+}
+
+type KeyValue struct {
+	Key   string
+	Value string
+}
+
+type Mount struct {
+	ContainerPath string
+	HostPath      string
+	Readonly      bool
+}
+
+type LinuxContainerSecurityContext struct {
+	RunAsUser          *int64
+	SupplementalGroups []int64
+	Privileged         bool
+	Capabilities       *Capability
+	ReadonlyRootfs     bool
+}
+
+type Capability struct {
+	AddCapabilities  []string
+	DropCapabilities []string
+}
+
+type LinuxContainerResources struct {
+	CpuPeriod          int64
+	CpuQuota           int64
+	CpuShares          int64
+	MemoryLimitInBytes int64
+	OomScoreAdj        int64
+}
+
+type ContainerMetadata struct {
+	Name string
+}
+
+type ContainerConfig struct {
+	Metadata    *ContainerMetadata
+	Image       *ImageSpec
+	Command     []string
+	Args        []string
+	Envs        []*KeyValue
+	Mounts      []*Mount
+	Labels      map[string]string
+	Annotations map[string]string
+	Resources   *LinuxContainerResources
+	Security    *LinuxContainerSecurityContext
+}
+
+// PodSandboxMetadata identifies the pod sandbox a container is created
+// in, mirroring the CRI's own PodSandboxMetadata (name/namespace/uid
+// plus the sandbox's restart attempt count).
+type PodSandboxMetadata struct {
+	Name      string
+	Uid       string
+	Namespace string
+	Attempt   uint32
+}
+
+type PodSandboxConfig struct {
+	Metadata *PodSandboxMetadata
+}
+
+type Container struct {
+	Id       string
+	Metadata *ContainerMetadata
+}
+
+// ContainerStatus is the version-neutral subset of CRI's ContainerStatus
+// that the diagnostics API cares about.
+type ContainerStatus struct {
+	State    string
+	Image    string
+	LogPath  string
+	ExitCode int32
+	Reason   string
+}
+
+// AuthConfig carries the credentials used to pull a private sidecar
+// image, resolved from imagePullSecrets or the node's docker config.
+type AuthConfig struct {
+	Username      string
+	Password      string
+	Auth          string
+	ServerAddress string
+	IdentityToken string
+}
@@ -0,0 +1,89 @@
+// Package client is a small Go client for the istioproxyagent
+// diagnostics API exposed by pkg/istioproxyagent/server.InfoServer.
+// It mirrors the usual container-engine client pattern: a custom
+// http.Transport dials the agent's unix socket, and each endpoint is
+// wrapped in a typed method.
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+
+	"istio.io/cni/pkg/istioproxyagent/api"
+)
+
+const defaultSocket = "/var/run/istio-proxy-agent.sock"
+
+// Client talks to the istioproxyagent diagnostics API over a unix
+// socket.
+type Client struct {
+	httpClient http.Client
+}
+
+// New returns a Client dialing the agent's diagnostics socket at
+// socketPath. An empty socketPath uses the agent's default,
+// /var/run/istio-proxy-agent.sock.
+func New(socketPath string) *Client {
+	if socketPath == "" {
+		socketPath = defaultSocket
+	}
+
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socketPath)
+		},
+	}
+
+	return &Client{httpClient: http.Client{Transport: transport}}
+}
+
+// Info returns the agent's GET /info response.
+func (c *Client) Info() (*api.InfoResponse, error) {
+	info := &api.InfoResponse{}
+	if err := c.get("/info", info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// Proxies returns the agent's GET /proxies response: a summary of every
+// sidecar the agent knows about.
+func (c *Client) Proxies() ([]*api.ProxySummary, error) {
+	var proxies []*api.ProxySummary
+	if err := c.get("/proxies", &proxies); err != nil {
+		return nil, err
+	}
+	return proxies, nil
+}
+
+// Proxy returns the agent's GET /proxies/{podUID} response: the
+// runtime's container status and a tail of the sidecar's logs.
+func (c *Client) Proxy(podUID string) (*api.ProxyDetail, error) {
+	detail := &api.ProxyDetail{}
+	if err := c.get("/proxies/"+podUID, detail); err != nil {
+		return nil, err
+	}
+	return detail, nil
+}
+
+func (c *Client) get(path string, out interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, "http://istio-proxy-agent"+path, nil)
+	if err != nil {
+		return err
+	}
+
+	response, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: unexpected status %s", path, response.Status)
+	}
+
+	return json.NewDecoder(response.Body).Decode(out)
+}
@@ -0,0 +1,337 @@
+package kube
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"path/filepath"
+
+	"istio.io/cni/pkg/istioproxyagent/api"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+	"k8s.io/kubernetes/third_party/forked/golang/expansion"
+)
+
+const (
+	// defaultCPUPeriod mirrors the CFS period kubelet itself uses when
+	// converting a container's cpu limit into a quota.
+	defaultCPUPeriod = int64(100000)
+	minCPUShares     = int64(2)
+)
+
+// PodToContainerConfig translates the sole container in pod.Spec.Containers
+// (see BuildSidecarPod) into the version-neutral api.ContainerConfig that
+// CRIRuntime hands to its adapter. kubeClient is used to resolve EnvFrom
+// ConfigMapRef/SecretRef sources and secret/configMap volumes; it may be
+// nil if the container uses neither.
+// The returned volumeDirs are the node-local directories containerMounts
+// materialized for emptyDir/secret/configMap volumes; the caller owns
+// them and must remove them once the sidecar is stopped.
+func PodToContainerConfig(kubeClient kubernetes.Interface, pod v1.Pod) (config *api.ContainerConfig, volumeDirs []string, err error) {
+	if len(pod.Spec.Containers) != 1 {
+		return nil, nil, fmt.Errorf("expected exactly one container in pod spec, got %d", len(pod.Spec.Containers))
+	}
+	container := pod.Spec.Containers[0]
+
+	envs, err := containerEnvs(kubeClient, pod, container)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not resolve environment for container %s: %v", container.Name, err)
+	}
+
+	mounts, volumeDirs, err := containerMounts(kubeClient, pod, container)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not resolve volume mounts for container %s: %v", container.Name, err)
+	}
+
+	hash, err := containerHash(container)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not hash container spec: %v", err)
+	}
+
+	return &api.ContainerConfig{
+		Metadata: &api.ContainerMetadata{
+			Name: container.Name,
+		},
+		Image: &api.ImageSpec{
+			Image: container.Image,
+		},
+		Command:   container.Command,
+		Args:      container.Args,
+		Envs:      envs,
+		Mounts:    mounts,
+		Resources: containerResources(container),
+		Security:  containerSecurity(container),
+		Labels: map[string]string{
+			"io.kubernetes.container.name": container.Name,
+			"io.kubernetes.pod.name":       pod.Name,
+			"io.kubernetes.pod.namespace":  pod.Namespace,
+			"io.kubernetes.pod.uid":        string(pod.UID),
+		},
+		Annotations: map[string]string{
+			"io.kubernetes.container.terminationMessagePath":   "/dev/termination-log",
+			"io.kubernetes.container.terminationMessagePolicy": "File",
+			"io.kubernetes.container.hash":                     hash,
+			"io.kubernetes.container.restartCount":             "0",
+		},
+	}, volumeDirs, nil
+}
+
+// containerResources translates Requests/Limits to the cgroup knobs the
+// CRI expects, the same way kubelet's own cm package does: cpu shares
+// come from the request (minCPUShares when there is none), cpu quota
+// from the limit (against a fixed 100ms period), and the memory limit
+// is passed straight through.
+func containerResources(container v1.Container) *api.LinuxContainerResources {
+	resources := &api.LinuxContainerResources{CpuPeriod: defaultCPUPeriod}
+
+	request := container.Resources.Requests[v1.ResourceCPU]
+	resources.CpuShares = milliCPUToShares(request.MilliValue())
+	if limit, ok := container.Resources.Limits[v1.ResourceCPU]; ok {
+		resources.CpuQuota = milliCPUToQuota(limit.MilliValue(), defaultCPUPeriod)
+	}
+	if limit, ok := container.Resources.Limits[v1.ResourceMemory]; ok {
+		resources.MemoryLimitInBytes = limit.Value()
+	}
+
+	return resources
+}
+
+func milliCPUToShares(milliCPU int64) int64 {
+	shares := (milliCPU * 1024) / 1000
+	if shares < minCPUShares {
+		return minCPUShares
+	}
+	return shares
+}
+
+func milliCPUToQuota(milliCPU, period int64) int64 {
+	if milliCPU == 0 {
+		return 0
+	}
+	return (milliCPU * period) / 1000
+}
+
+// containerSecurity translates the subset of v1.SecurityContext the
+// sidecar injection template sets.
+func containerSecurity(container v1.Container) *api.LinuxContainerSecurityContext {
+	security := &api.LinuxContainerSecurityContext{
+		SupplementalGroups: []int64{0},
+		Privileged:         true,
+	}
+
+	sc := container.SecurityContext
+	if sc == nil {
+		return security
+	}
+
+	security.RunAsUser = sc.RunAsUser
+	if sc.Privileged != nil {
+		security.Privileged = *sc.Privileged
+	}
+	if sc.ReadOnlyRootFilesystem != nil {
+		security.ReadonlyRootfs = *sc.ReadOnlyRootFilesystem
+	}
+	if sc.Capabilities != nil {
+		security.Capabilities = &api.Capability{
+			AddCapabilities:  capabilitiesToStrings(sc.Capabilities.Add),
+			DropCapabilities: capabilitiesToStrings(sc.Capabilities.Drop),
+		}
+	}
+
+	return security
+}
+
+func capabilitiesToStrings(capabilities []v1.Capability) []string {
+	result := make([]string, 0, len(capabilities))
+	for _, c := range capabilities {
+		result = append(result, string(c))
+	}
+	return result
+}
+
+// containerMounts resolves the container's VolumeMounts against the
+// pod's Volumes, honoring subPath and subPathExpr. hostPath volumes
+// resolve directly to their HostPath; emptyDir, secret and configMap
+// volumes are materialized onto the node (a scratch directory, or a
+// directory populated from the referenced object's data) since the pod
+// never actually went through kubelet's own volume manager. Any other
+// volume type (e.g. projected) isn't materialized and is skipped, but
+// never silently - a warning names the volume and mount it came from.
+// The returned volumeDirs are the directories it materialized; the
+// caller owns them and must remove them once the sidecar is stopped.
+func containerMounts(kubeClient kubernetes.Interface, pod v1.Pod, container v1.Container) ([]*api.Mount, []string, error) {
+	volumes := map[string]v1.Volume{}
+	for _, volume := range pod.Spec.Volumes {
+		volumes[volume.Name] = volume
+	}
+
+	downwardAPI := map[string]string{
+		"POD_NAME":      pod.Name,
+		"POD_NAMESPACE": pod.Namespace,
+		"POD_UID":       string(pod.UID),
+	}
+	mappingFunc := expansion.MappingFuncFor(downwardAPI)
+
+	type resolved struct {
+		hostPath     string
+		readonly     bool
+		materialized bool
+	}
+	resolvedVolumes := map[string]resolved{}
+	var volumeDirs []string
+
+	mounts := make([]*api.Mount, 0, len(container.VolumeMounts))
+	for _, volumeMount := range container.VolumeMounts {
+		volume, ok := volumes[volumeMount.Name]
+		if !ok {
+			klog.Warningf("container %s: volumeMount %q has no matching volume in the pod spec, skipping", container.Name, volumeMount.Name)
+			continue
+		}
+
+		r, ok := resolvedVolumes[volume.Name]
+		if !ok {
+			hostPath, readonly, materialized, err := resolveVolumeHostPath(kubeClient, pod.Namespace, volume)
+			if err != nil {
+				return nil, volumeDirs, err
+			}
+			r = resolved{hostPath: hostPath, readonly: readonly, materialized: materialized}
+			resolvedVolumes[volume.Name] = r
+			if materialized {
+				volumeDirs = append(volumeDirs, hostPath)
+			}
+		}
+		if r.hostPath == "" {
+			klog.Warningf("container %s: volumeMount %q uses an unsupported volume type for volume %q, skipping", container.Name, volumeMount.Name, volume.Name)
+			continue
+		}
+
+		readonly := r.readonly || volumeMount.ReadOnly
+
+		subPath := volumeMount.SubPath
+		if volumeMount.SubPathExpr != "" {
+			subPath = expansion.Expand(volumeMount.SubPathExpr, mappingFunc)
+		}
+		hostPath := r.hostPath
+		if subPath != "" {
+			hostPath = filepath.Join(hostPath, subPath)
+		}
+
+		mounts = append(mounts, &api.Mount{
+			ContainerPath: volumeMount.MountPath,
+			HostPath:      hostPath,
+			Readonly:      readonly,
+		})
+	}
+
+	return mounts, volumeDirs, nil
+}
+
+// resolveVolumeHostPath returns the node-local directory volume should
+// be bind-mounted from, whether that directory should be mounted
+// read-only, and whether it is one this function just materialized onto
+// the node (as opposed to a real, pre-existing hostPath) and therefore
+// needs to be cleaned up once the sidecar using it is stopped. It
+// returns an empty hostPath for volume types it doesn't know how to
+// materialize.
+func resolveVolumeHostPath(kubeClient kubernetes.Interface, namespace string, volume v1.Volume) (hostPath string, readonly bool, materialized bool, err error) {
+	switch {
+	case volume.HostPath != nil:
+		return volume.HostPath.Path, false, false, nil
+
+	case volume.EmptyDir != nil:
+		dir, err := ioutil.TempDir("", "emptydir-"+volume.Name+"-")
+		if err != nil {
+			return "", false, false, fmt.Errorf("could not create emptyDir volume %q: %v", volume.Name, err)
+		}
+		return dir, false, true, nil
+
+	case volume.Secret != nil:
+		dir, err := materializeSecretVolume(kubeClient, namespace, volume.Secret)
+		if err != nil {
+			return "", false, false, err
+		}
+		return dir, true, true, nil
+
+	case volume.ConfigMap != nil:
+		dir, err := materializeConfigMapVolume(kubeClient, namespace, volume.ConfigMap)
+		if err != nil {
+			return "", false, false, err
+		}
+		return dir, true, true, nil
+
+	default:
+		return "", false, false, nil
+	}
+}
+
+// materializeSecretVolume fetches secret's data and writes it out as
+// one file per key in a fresh directory, so it can be bind-mounted the
+// same way kubelet's own secret volume plugin lays it out.
+func materializeSecretVolume(kubeClient kubernetes.Interface, namespace string, secret *v1.SecretVolumeSource) (string, error) {
+	if kubeClient == nil {
+		return "", fmt.Errorf("secret volume %s: no kube client available", secret.SecretName)
+	}
+	obj, err := kubeClient.CoreV1().Secrets(namespace).Get(secret.SecretName, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("secret volume %s: %v", secret.SecretName, err)
+	}
+	dir, err := ioutil.TempDir("", "secret-"+secret.SecretName+"-")
+	if err != nil {
+		return "", fmt.Errorf("secret volume %s: %v", secret.SecretName, err)
+	}
+	for key, value := range obj.Data {
+		if err := ioutil.WriteFile(filepath.Join(dir, key), value, 0444); err != nil {
+			return "", fmt.Errorf("secret volume %s: %v", secret.SecretName, err)
+		}
+	}
+	return dir, nil
+}
+
+// materializeConfigMapVolume fetches configMap's data and writes it out
+// as one file per key in a fresh directory, mirroring
+// materializeSecretVolume.
+func materializeConfigMapVolume(kubeClient kubernetes.Interface, namespace string, configMap *v1.ConfigMapVolumeSource) (string, error) {
+	if kubeClient == nil {
+		return "", fmt.Errorf("configMap volume %s: no kube client available", configMap.Name)
+	}
+	obj, err := kubeClient.CoreV1().ConfigMaps(namespace).Get(configMap.Name, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("configMap volume %s: %v", configMap.Name, err)
+	}
+	dir, err := ioutil.TempDir("", "configmap-"+configMap.Name+"-")
+	if err != nil {
+		return "", fmt.Errorf("configMap volume %s: %v", configMap.Name, err)
+	}
+	for key, value := range obj.Data {
+		if err := ioutil.WriteFile(filepath.Join(dir, key), []byte(value), 0444); err != nil {
+			return "", fmt.Errorf("configMap volume %s: %v", configMap.Name, err)
+		}
+	}
+	for key, value := range obj.BinaryData {
+		if err := ioutil.WriteFile(filepath.Join(dir, key), value, 0444); err != nil {
+			return "", fmt.Errorf("configMap volume %s: %v", configMap.Name, err)
+		}
+	}
+	return dir, nil
+}
+
+// containerHash computes a deterministic hash over the container spec,
+// the same way dockershim stamped io.kubernetes.container.hash so
+// kubelet-style restart detection (did the container spec change since
+// it was created?) keeps working.
+func containerHash(container v1.Container) (string, error) {
+	data, err := json.Marshal(container)
+	if err != nil {
+		return "", err
+	}
+
+	h := fnv.New32a()
+	if _, err := h.Write(data); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%08x", h.Sum32()), nil
+}
@@ -0,0 +1,316 @@
+package kube
+
+import (
+	"os"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestContainerResources(t *testing.T) {
+	tests := []struct {
+		name          string
+		requests      v1.ResourceList
+		limits        v1.ResourceList
+		wantShares    int64
+		wantQuota     int64
+		wantMemoryLim int64
+	}{
+		{
+			name:       "no resources set falls back to minimum shares",
+			wantShares: minCPUShares,
+		},
+		{
+			name:       "cpu request converts to shares",
+			requests:   v1.ResourceList{v1.ResourceCPU: resource.MustParse("500m")},
+			wantShares: 512,
+		},
+		{
+			name:       "cpu limit converts to quota against the fixed period",
+			limits:     v1.ResourceList{v1.ResourceCPU: resource.MustParse("250m")},
+			wantShares: minCPUShares,
+			wantQuota:  25000,
+		},
+		{
+			name:          "memory limit passes straight through",
+			limits:        v1.ResourceList{v1.ResourceMemory: resource.MustParse("128Mi")},
+			wantShares:    minCPUShares,
+			wantMemoryLim: 128 * 1024 * 1024,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			container := v1.Container{
+				Resources: v1.ResourceRequirements{Requests: tt.requests, Limits: tt.limits},
+			}
+			got := containerResources(container)
+			if got.CpuShares != tt.wantShares {
+				t.Errorf("CpuShares = %d, want %d", got.CpuShares, tt.wantShares)
+			}
+			if got.CpuQuota != tt.wantQuota {
+				t.Errorf("CpuQuota = %d, want %d", got.CpuQuota, tt.wantQuota)
+			}
+			if got.MemoryLimitInBytes != tt.wantMemoryLim {
+				t.Errorf("MemoryLimitInBytes = %d, want %d", got.MemoryLimitInBytes, tt.wantMemoryLim)
+			}
+			if got.CpuPeriod != defaultCPUPeriod {
+				t.Errorf("CpuPeriod = %d, want %d", got.CpuPeriod, defaultCPUPeriod)
+			}
+		})
+	}
+}
+
+func TestContainerSecurity(t *testing.T) {
+	runAsUser := int64(1337)
+	privileged := false
+	readOnly := true
+
+	container := v1.Container{
+		SecurityContext: &v1.SecurityContext{
+			RunAsUser:              &runAsUser,
+			Privileged:             &privileged,
+			ReadOnlyRootFilesystem: &readOnly,
+			Capabilities: &v1.Capabilities{
+				Add:  []v1.Capability{"NET_ADMIN"},
+				Drop: []v1.Capability{"ALL"},
+			},
+		},
+	}
+
+	got := containerSecurity(container)
+
+	if got.RunAsUser == nil || *got.RunAsUser != runAsUser {
+		t.Errorf("RunAsUser = %v, want %d", got.RunAsUser, runAsUser)
+	}
+	if got.Privileged {
+		t.Error("Privileged = true, want false (explicit SecurityContext.Privileged=false)")
+	}
+	if !got.ReadonlyRootfs {
+		t.Error("ReadonlyRootfs = false, want true")
+	}
+	if got.Capabilities == nil || len(got.Capabilities.AddCapabilities) != 1 || got.Capabilities.AddCapabilities[0] != "NET_ADMIN" {
+		t.Errorf("Capabilities.AddCapabilities = %v, want [NET_ADMIN]", got.Capabilities)
+	}
+	if got.Capabilities == nil || len(got.Capabilities.DropCapabilities) != 1 || got.Capabilities.DropCapabilities[0] != "ALL" {
+		t.Errorf("Capabilities.DropCapabilities = %v, want [ALL]", got.Capabilities)
+	}
+}
+
+func TestContainerSecurity_DefaultsWithoutSecurityContext(t *testing.T) {
+	got := containerSecurity(v1.Container{})
+	if !got.Privileged {
+		t.Error("Privileged = false, want true (default when no SecurityContext is set)")
+	}
+	if len(got.SupplementalGroups) != 1 || got.SupplementalGroups[0] != 0 {
+		t.Errorf("SupplementalGroups = %v, want [0]", got.SupplementalGroups)
+	}
+}
+
+func TestContainerHash_DeterministicAndSensitiveToSpec(t *testing.T) {
+	c1 := v1.Container{Name: "istio-proxy", Image: "istio/proxyv2:1.0"}
+	c2 := v1.Container{Name: "istio-proxy", Image: "istio/proxyv2:1.0"}
+	c3 := v1.Container{Name: "istio-proxy", Image: "istio/proxyv2:1.1"}
+
+	h1, err := containerHash(c1)
+	if err != nil {
+		t.Fatalf("containerHash(c1): %v", err)
+	}
+	h2, err := containerHash(c2)
+	if err != nil {
+		t.Fatalf("containerHash(c2): %v", err)
+	}
+	h3, err := containerHash(c3)
+	if err != nil {
+		t.Fatalf("containerHash(c3): %v", err)
+	}
+
+	if h1 != h2 {
+		t.Errorf("containerHash is not deterministic: %q != %q for identical containers", h1, h2)
+	}
+	if h1 == h3 {
+		t.Errorf("containerHash did not change when the image changed: both %q", h1)
+	}
+}
+
+func TestContainerMounts_HostPathWithSubPathExpr(t *testing.T) {
+	pod := v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "my-pod", Namespace: "default", UID: "pod-uid"},
+		Spec: v1.PodSpec{
+			Volumes: []v1.Volume{
+				{Name: "data", VolumeSource: v1.VolumeSource{HostPath: &v1.HostPathVolumeSource{Path: "/var/lib/data"}}},
+			},
+		},
+	}
+	container := v1.Container{
+		VolumeMounts: []v1.VolumeMount{
+			{Name: "data", MountPath: "/data", SubPathExpr: "$(POD_NAME)"},
+		},
+	}
+
+	mounts, volumeDirs, err := containerMounts(nil, pod, container)
+	if err != nil {
+		t.Fatalf("containerMounts: %v", err)
+	}
+	if len(volumeDirs) != 0 {
+		t.Errorf("volumeDirs = %v, want none (hostPath volumes aren't materialized)", volumeDirs)
+	}
+	if len(mounts) != 1 {
+		t.Fatalf("len(mounts) = %d, want 1", len(mounts))
+	}
+	want := "/var/lib/data/my-pod"
+	if mounts[0].HostPath != want {
+		t.Errorf("HostPath = %q, want %q", mounts[0].HostPath, want)
+	}
+	if mounts[0].ContainerPath != "/data" {
+		t.Errorf("ContainerPath = %q, want %q", mounts[0].ContainerPath, "/data")
+	}
+}
+
+func TestContainerMounts_EmptyDirAndSecretAndConfigMap(t *testing.T) {
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "certs", Namespace: "default"},
+		Data:       map[string][]byte{"cert.pem": []byte("cert-data")},
+	}
+	configMap := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "mesh-config", Namespace: "default"},
+		Data:       map[string]string{"mesh": "config-data"},
+	}
+	kubeClient := fake.NewSimpleClientset(secret, configMap)
+
+	pod := v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "my-pod", Namespace: "default"},
+		Spec: v1.PodSpec{
+			Volumes: []v1.Volume{
+				{Name: "scratch", VolumeSource: v1.VolumeSource{EmptyDir: &v1.EmptyDirVolumeSource{}}},
+				{Name: "certs", VolumeSource: v1.VolumeSource{Secret: &v1.SecretVolumeSource{SecretName: "certs"}}},
+				{Name: "mesh-config", VolumeSource: v1.VolumeSource{ConfigMap: &v1.ConfigMapVolumeSource{LocalObjectReference: v1.LocalObjectReference{Name: "mesh-config"}}}},
+			},
+		},
+	}
+	container := v1.Container{
+		VolumeMounts: []v1.VolumeMount{
+			{Name: "scratch", MountPath: "/scratch"},
+			{Name: "certs", MountPath: "/etc/certs", ReadOnly: true},
+			{Name: "mesh-config", MountPath: "/etc/istio"},
+		},
+	}
+
+	mounts, volumeDirs, err := containerMounts(kubeClient, pod, container)
+	if err != nil {
+		t.Fatalf("containerMounts: %v", err)
+	}
+	if len(mounts) != 3 {
+		t.Fatalf("len(mounts) = %d, want 3", len(mounts))
+	}
+	if len(volumeDirs) != 3 {
+		t.Fatalf("len(volumeDirs) = %d, want 3 (one materialized dir per volume, for cleanup on stop)", len(volumeDirs))
+	}
+	for _, dir := range volumeDirs {
+		if _, err := os.Stat(dir); err != nil {
+			t.Errorf("materialized volume dir %q does not exist on disk: %v", dir, err)
+		}
+	}
+	t.Cleanup(func() {
+		for _, dir := range volumeDirs {
+			os.RemoveAll(dir)
+		}
+	})
+
+	byContainerPath := map[string]*mountResult{}
+	for _, m := range mounts {
+		byContainerPath[m.ContainerPath] = &mountResult{HostPath: m.HostPath, Readonly: m.Readonly}
+	}
+
+	if _, ok := byContainerPath["/scratch"]; !ok {
+		t.Error("missing mount for emptyDir volume")
+	}
+	if m, ok := byContainerPath["/etc/certs"]; !ok || !m.Readonly {
+		t.Error("secret volume mount should be present and read-only")
+	}
+	if m, ok := byContainerPath["/etc/istio"]; !ok || !m.Readonly {
+		t.Error("configMap volume mount should be present and read-only")
+	}
+}
+
+type mountResult struct {
+	HostPath string
+	Readonly bool
+}
+
+func TestContainerMounts_UnknownVolumeSkippedNotErrored(t *testing.T) {
+	pod := v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "my-pod", Namespace: "default"},
+		Spec: v1.PodSpec{
+			Volumes: []v1.Volume{
+				{Name: "proj", VolumeSource: v1.VolumeSource{Projected: &v1.ProjectedVolumeSource{}}},
+			},
+		},
+	}
+	container := v1.Container{
+		VolumeMounts: []v1.VolumeMount{
+			{Name: "proj", MountPath: "/proj"},
+			{Name: "missing", MountPath: "/missing"},
+		},
+	}
+
+	mounts, volumeDirs, err := containerMounts(nil, pod, container)
+	if err != nil {
+		t.Fatalf("containerMounts: %v", err)
+	}
+	if len(mounts) != 0 {
+		t.Errorf("len(mounts) = %d, want 0 (unsupported/unknown volumes should be skipped, not materialized)", len(mounts))
+	}
+	if len(volumeDirs) != 0 {
+		t.Errorf("volumeDirs = %v, want none (unsupported volumes aren't materialized)", volumeDirs)
+	}
+}
+
+func TestContainerEnvs_EnvFromConfigMapAndSecret(t *testing.T) {
+	configMap := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "app-config", Namespace: "default"},
+		Data:       map[string]string{"LOG_LEVEL": "debug"},
+	}
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "app-secret", Namespace: "default"},
+		Data:       map[string][]byte{"TOKEN": []byte("s3cr3t")},
+	}
+	kubeClient := fake.NewSimpleClientset(configMap, secret)
+
+	pod := v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "my-pod", Namespace: "default", UID: "pod-uid"},
+		Status:     v1.PodStatus{PodIP: "10.0.0.5"},
+	}
+	container := v1.Container{
+		EnvFrom: []v1.EnvFromSource{
+			{ConfigMapRef: &v1.ConfigMapEnvSource{LocalObjectReference: v1.LocalObjectReference{Name: "app-config"}}},
+			{SecretRef: &v1.SecretEnvSource{LocalObjectReference: v1.LocalObjectReference{Name: "app-secret"}}},
+		},
+		Env: []v1.EnvVar{
+			{Name: "POD_IP", ValueFrom: &v1.EnvVarSource{FieldRef: &v1.ObjectFieldSelector{FieldPath: "status.podIP"}}},
+		},
+	}
+
+	envs, err := containerEnvs(kubeClient, pod, container)
+	if err != nil {
+		t.Fatalf("containerEnvs: %v", err)
+	}
+
+	got := map[string]string{}
+	for _, e := range envs {
+		got[e.Key] = e.Value
+	}
+
+	if got["LOG_LEVEL"] != "debug" {
+		t.Errorf("LOG_LEVEL = %q, want %q", got["LOG_LEVEL"], "debug")
+	}
+	if got["TOKEN"] != "s3cr3t" {
+		t.Errorf("TOKEN = %q, want %q", got["TOKEN"], "s3cr3t")
+	}
+	if got["POD_IP"] != "10.0.0.5" {
+		t.Errorf("POD_IP = %q, want %q", got["POD_IP"], "10.0.0.5")
+	}
+}
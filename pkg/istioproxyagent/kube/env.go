@@ -0,0 +1,103 @@
+package kube
+
+import (
+	"fmt"
+
+	"istio.io/cni/pkg/istioproxyagent/api"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/kubernetes/third_party/forked/golang/expansion"
+)
+
+// containerEnvs resolves container.EnvFrom (ConfigMapRef/SecretRef,
+// fetched via kubeClient) and container.Env (including the
+// "metadata.*"/"status.podIP" downward API field refs the sidecar
+// template relies on) into the flat key/value list the CRI expects.
+func containerEnvs(kubeClient kubernetes.Interface, pod v1.Pod, container v1.Container) ([]*api.KeyValue, error) {
+	merged := map[string]string{}
+	var order []string
+
+	set := func(key, value string) {
+		if _, exists := merged[key]; !exists {
+			order = append(order, key)
+		}
+		merged[key] = value
+	}
+
+	for _, source := range container.EnvFrom {
+		values, err := envFromSource(kubeClient, pod.Namespace, source)
+		if err != nil {
+			return nil, err
+		}
+		for key, value := range values {
+			set(source.Prefix+key, value)
+		}
+	}
+
+	mappingFunc := expansion.MappingFuncFor(merged)
+	for _, e := range container.Env {
+		value := e.Value
+
+		if e.ValueFrom != nil && e.ValueFrom.FieldRef != nil {
+			switch e.ValueFrom.FieldRef.FieldPath {
+			case "metadata.uid":
+				value = string(pod.UID)
+			case "metadata.name":
+				value = pod.Name
+			case "metadata.namespace":
+				value = pod.Namespace
+			case "status.podIP":
+				value = pod.Status.PodIP
+			}
+		}
+
+		value = expansion.Expand(value, mappingFunc)
+		set(e.Name, value)
+	}
+
+	result := make([]*api.KeyValue, 0, len(order))
+	for _, key := range order {
+		result = append(result, &api.KeyValue{Key: key, Value: merged[key]})
+	}
+	return result, nil
+}
+
+func envFromSource(kubeClient kubernetes.Interface, namespace string, source v1.EnvFromSource) (map[string]string, error) {
+	optional := func(ref *v1.LocalObjectReference, opt *bool) bool { return opt != nil && *opt }
+
+	switch {
+	case source.ConfigMapRef != nil:
+		if kubeClient == nil {
+			return nil, fmt.Errorf("envFrom configMapRef %s: no kube client available", source.ConfigMapRef.Name)
+		}
+		configMap, err := kubeClient.CoreV1().ConfigMaps(namespace).Get(source.ConfigMapRef.Name, metav1.GetOptions{})
+		if err != nil {
+			if optional(&source.ConfigMapRef.LocalObjectReference, source.ConfigMapRef.Optional) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("envFrom configMapRef %s: %v", source.ConfigMapRef.Name, err)
+		}
+		return configMap.Data, nil
+
+	case source.SecretRef != nil:
+		if kubeClient == nil {
+			return nil, fmt.Errorf("envFrom secretRef %s: no kube client available", source.SecretRef.Name)
+		}
+		secret, err := kubeClient.CoreV1().Secrets(namespace).Get(source.SecretRef.Name, metav1.GetOptions{})
+		if err != nil {
+			if optional(&source.SecretRef.LocalObjectReference, source.SecretRef.Optional) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("envFrom secretRef %s: %v", source.SecretRef.Name, err)
+		}
+		values := make(map[string]string, len(secret.Data))
+		for key, value := range secret.Data {
+			values[key] = string(value)
+		}
+		return values, nil
+
+	default:
+		return nil, nil
+	}
+}
@@ -0,0 +1,23 @@
+// Package kube builds the istio-proxy sidecar's CRI container config
+// from a real Kubernetes object instead of a hand-built criapi struct.
+// BuildSidecarPod wraps the sidecar container (as produced by the
+// injection template) into a synthetic single-container v1.Pod, and
+// PodToContainerConfig translates that pod into the version-neutral
+// api.ContainerConfig CRIRuntime hands to its adapter. Keeping a real
+// v1.Pod as the intermediate representation, rather than threading
+// individual fields through, mirrors how kubectl/podman's "play kube"
+// commands turn a manifest into a container spec.
+package kube
+
+import (
+	v1 "k8s.io/api/core/v1"
+)
+
+// BuildSidecarPod returns a copy of pod whose spec contains only the
+// sidecar container, so PodToContainerConfig has a single well-defined
+// container to translate.
+func BuildSidecarPod(pod v1.Pod, sidecar v1.Container) v1.Pod {
+	sidecarPod := pod
+	sidecarPod.Spec.Containers = []v1.Container{sidecar}
+	return sidecarPod
+}
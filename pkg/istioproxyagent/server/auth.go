@@ -0,0 +1,221 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"istio.io/cni/pkg/istioproxyagent/api"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+)
+
+const (
+	dockerConfigJSONKey = ".dockerconfigjson"
+	defaultRegistry     = "index.docker.io"
+)
+
+// dockerConfigEntry is one entry of the "auths" map in a
+// kubernetes.io/dockerconfigjson secret or a docker config.json file.
+type dockerConfigEntry struct {
+	Username      string `json:"username"`
+	Password      string `json:"password"`
+	Auth          string `json:"auth"`
+	IdentityToken string `json:"identitytoken"`
+}
+
+type dockerConfigFile struct {
+	Auths map[string]dockerConfigEntry `json:"auths"`
+}
+
+// imagePullAuthResolver resolves the credentials to use when pulling a
+// sidecar image, first from the pod's imagePullSecrets and then from the
+// node-level docker config files that kubelet itself falls back to.
+type imagePullAuthResolver struct {
+	kubeClient kubernetes.Interface
+
+	mu    sync.Mutex
+	cache map[string]map[string]dockerConfigEntry // authCacheKey(namespace, secretNames) -> registry -> entry
+}
+
+func newImagePullAuthResolver(kubeClient kubernetes.Interface) *imagePullAuthResolver {
+	return &imagePullAuthResolver{
+		kubeClient: kubeClient,
+		cache:      map[string]map[string]dockerConfigEntry{},
+	}
+}
+
+// resolve returns the AuthConfig to use for image, or an error naming
+// the registry if no imagePullSecret or docker config file has a
+// matching entry.
+func (r *imagePullAuthResolver) resolve(namespace string, secretNames []string, image string) (*api.AuthConfig, error) {
+	registry := registryHostForImage(image)
+
+	auths, err := r.authsForNamespace(namespace, secretNames)
+	if err != nil {
+		klog.Warningf("Error reading imagePullSecrets for namespace %s: %v", namespace, err)
+	}
+	if entry, ok := auths[registry]; ok {
+		return entryToAuthConfig(registry, entry), nil
+	}
+
+	for _, path := range nodeDockerConfigPaths() {
+		fileAuths, err := readDockerConfigFile(path)
+		if err != nil {
+			continue
+		}
+		if entry, ok := matchRegistry(fileAuths, registry); ok {
+			return entryToAuthConfig(registry, entry), nil
+		}
+	}
+
+	return nil, fmt.Errorf("no image pull credentials found for registry %q: checked %d imagePullSecret(s) in namespace %s and the node's docker config files", registry, len(secretNames), namespace)
+}
+
+func (r *imagePullAuthResolver) authsForNamespace(namespace string, secretNames []string) (map[string]dockerConfigEntry, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := authCacheKey(namespace, secretNames)
+	if cached, ok := r.cache[key]; ok {
+		return cached, nil
+	}
+
+	if r.kubeClient == nil {
+		return nil, fmt.Errorf("no kube client available to read imagePullSecrets")
+	}
+
+	merged := map[string]dockerConfigEntry{}
+	var firstErr error
+	for _, name := range secretNames {
+		secret, err := r.kubeClient.CoreV1().Secrets(namespace).Get(name, metav1.GetOptions{})
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if secret.Type != v1.SecretTypeDockerConfigJson {
+			continue
+		}
+		file, err := parseDockerConfigJSON(secret.Data[dockerConfigJSONKey])
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		for host, entry := range file.Auths {
+			merged[normalizeRegistryHost(host)] = entry
+		}
+	}
+
+	r.cache[key] = merged
+	return merged, firstErr
+}
+
+// authCacheKey identifies a (namespace, secretNames) pair regardless of
+// the order secretNames was given in, so a pod naming a different or
+// additional imagePullSecret in the same namespace doesn't reuse another
+// pod's merged auths.
+func authCacheKey(namespace string, secretNames []string) string {
+	sorted := append([]string{}, secretNames...)
+	sort.Strings(sorted)
+	return namespace + "|" + strings.Join(sorted, ",")
+}
+
+func parseDockerConfigJSON(data []byte) (*dockerConfigFile, error) {
+	file := &dockerConfigFile{}
+	if err := json.Unmarshal(data, file); err != nil {
+		return nil, fmt.Errorf("could not parse %s: %v", dockerConfigJSONKey, err)
+	}
+	return file, nil
+}
+
+func readDockerConfigFile(path string) (*dockerConfigFile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseDockerConfigJSON(data)
+}
+
+func nodeDockerConfigPaths() []string {
+	paths := []string{"/var/lib/kubelet/config.json"}
+	if home, err := os.UserHomeDir(); err == nil {
+		paths = append(paths, filepath.Join(home, ".docker", "config.json"))
+	}
+	return paths
+}
+
+func matchRegistry(file *dockerConfigFile, registry string) (dockerConfigEntry, bool) {
+	for host, entry := range file.Auths {
+		if normalizeRegistryHost(host) == registry {
+			return entry, true
+		}
+	}
+	return dockerConfigEntry{}, false
+}
+
+// registryHostForImage extracts the registry host from an image
+// reference, defaulting to Docker Hub's canonical host.
+func registryHostForImage(image string) string {
+	ref := image
+	if i := strings.IndexByte(ref, '@'); i != -1 {
+		ref = ref[:i]
+	}
+	parts := strings.SplitN(ref, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		return normalizeRegistryHost(parts[0])
+	}
+	return defaultRegistry
+}
+
+// normalizeRegistryHost maps the various spellings of Docker Hub
+// ("docker.io", "index.docker.io/v1/", ...) to a single canonical host,
+// mirroring the normalization dockerd itself applies when matching
+// config.json entries against an image reference.
+func normalizeRegistryHost(host string) string {
+	host = strings.TrimSuffix(host, "/")
+	host = strings.TrimSuffix(host, "/v1")
+	switch host {
+	case "", "docker.io", "index.docker.io", "registry-1.docker.io":
+		return defaultRegistry
+	default:
+		return host
+	}
+}
+
+func entryToAuthConfig(registry string, entry dockerConfigEntry) *api.AuthConfig {
+	username, password := entry.Username, entry.Password
+	if entry.Auth != "" && (username == "" || password == "") {
+		if decoded, err := base64.StdEncoding.DecodeString(entry.Auth); err == nil {
+			if u, p, ok := splitAuth(string(decoded)); ok {
+				username, password = u, p
+			}
+		}
+	}
+	return &api.AuthConfig{
+		Username:      username,
+		Password:      password,
+		Auth:          entry.Auth,
+		ServerAddress: registry,
+		IdentityToken: entry.IdentityToken,
+	}
+}
+
+func splitAuth(decoded string) (string, string, bool) {
+	i := strings.IndexByte(decoded, ':')
+	if i == -1 {
+		return "", "", false
+	}
+	return decoded[:i], decoded[i+1:], true
+}
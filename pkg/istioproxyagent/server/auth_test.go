@@ -0,0 +1,122 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func dockerConfigSecret(name, namespace string, auths map[string]dockerConfigEntry) *v1.Secret {
+	data, _ := json.Marshal(dockerConfigFile{Auths: auths})
+	return &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		Type:       v1.SecretTypeDockerConfigJson,
+		Data:       map[string][]byte{dockerConfigJSONKey: data},
+	}
+}
+
+func TestEntryToAuthConfig(t *testing.T) {
+	tests := []struct {
+		name         string
+		entry        dockerConfigEntry
+		wantUsername string
+		wantPassword string
+		wantIdentity string
+	}{
+		{
+			name:         "plain username and password",
+			entry:        dockerConfigEntry{Username: "alice", Password: "hunter2"},
+			wantUsername: "alice",
+			wantPassword: "hunter2",
+		},
+		{
+			name:         "base64 auth decoded when username/password absent",
+			entry:        dockerConfigEntry{Auth: base64.StdEncoding.EncodeToString([]byte("bob:s3cr3t"))},
+			wantUsername: "bob",
+			wantPassword: "s3cr3t",
+		},
+		{
+			name:         "identity token is passed through regardless of auth encoding",
+			entry:        dockerConfigEntry{Auth: base64.StdEncoding.EncodeToString([]byte("bob:s3cr3t")), IdentityToken: "tok-123"},
+			wantUsername: "bob",
+			wantPassword: "s3cr3t",
+			wantIdentity: "tok-123",
+		},
+		{
+			name:         "malformed auth is left undecoded",
+			entry:        dockerConfigEntry{Auth: "not-base64!!"},
+			wantUsername: "",
+			wantPassword: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := entryToAuthConfig("my-registry.example.com", tt.entry)
+			if got.Username != tt.wantUsername || got.Password != tt.wantPassword {
+				t.Errorf("entryToAuthConfig(%+v) = username %q password %q, want %q %q", tt.entry, got.Username, got.Password, tt.wantUsername, tt.wantPassword)
+			}
+			if got.IdentityToken != tt.wantIdentity {
+				t.Errorf("entryToAuthConfig(%+v) IdentityToken = %q, want %q", tt.entry, got.IdentityToken, tt.wantIdentity)
+			}
+			if got.ServerAddress != "my-registry.example.com" {
+				t.Errorf("entryToAuthConfig(%+v) ServerAddress = %q, want %q", tt.entry, got.ServerAddress, "my-registry.example.com")
+			}
+		})
+	}
+}
+
+func TestImagePullAuthResolver_MultiRegistrySecrets(t *testing.T) {
+	secretA := dockerConfigSecret("regcred-a", "default", map[string]dockerConfigEntry{
+		"registry-a.example.com": {Username: "a-user", Password: "a-pass"},
+	})
+	secretB := dockerConfigSecret("regcred-b", "default", map[string]dockerConfigEntry{
+		"registry-b.example.com": {Username: "b-user", Password: "b-pass"},
+	})
+
+	kubeClient := fake.NewSimpleClientset(secretA, secretB)
+	resolver := newImagePullAuthResolver(kubeClient)
+
+	// First pod in the namespace only names secret A.
+	auth, err := resolver.resolve("default", []string{"regcred-a"}, "registry-a.example.com/app:latest")
+	if err != nil {
+		t.Fatalf("resolve with secret A: %v", err)
+	}
+	if auth.Username != "a-user" {
+		t.Errorf("resolve with secret A: Username = %q, want %q", auth.Username, "a-user")
+	}
+
+	// A second pod in the same namespace names a different secret. Before
+	// the cache was keyed on (namespace, secretNames), this would
+	// incorrectly reuse the first pod's merged auths and fail to find
+	// registry-b's credentials.
+	auth, err = resolver.resolve("default", []string{"regcred-b"}, "registry-b.example.com/app:latest")
+	if err != nil {
+		t.Fatalf("resolve with secret B: %v", err)
+	}
+	if auth.Username != "b-user" {
+		t.Errorf("resolve with secret B: Username = %q, want %q", auth.Username, "b-user")
+	}
+
+	// A pod naming both secrets sees both registries.
+	auth, err = resolver.resolve("default", []string{"regcred-a", "regcred-b"}, "registry-a.example.com/app:latest")
+	if err != nil {
+		t.Fatalf("resolve with both secrets: %v", err)
+	}
+	if auth.Username != "a-user" {
+		t.Errorf("resolve with both secrets: Username = %q, want %q", auth.Username, "a-user")
+	}
+}
+
+func TestImagePullAuthResolver_NoKubeClient(t *testing.T) {
+	resolver := newImagePullAuthResolver(nil)
+
+	_, err := resolver.authsForNamespace("default", []string{"regcred"})
+	if err == nil {
+		t.Fatal("authsForNamespace with no kube client: expected an error, got nil")
+	}
+}
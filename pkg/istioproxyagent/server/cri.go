@@ -3,21 +3,18 @@ package server
 import (
 	"crypto/sha256"
 	"encoding/hex"
-	"encoding/json"
+	"flag"
 	"fmt"
-	"github.com/containernetworking/plugins/pkg/ns"
 	"istio.io/cni/pkg/istioproxyagent/api"
+	"istio.io/cni/pkg/istioproxyagent/kube"
 	"istio.io/istio/pilot/pkg/kube/inject"
 	"istio.io/istio/pilot/pkg/model"
 	"k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/klog"
-	"k8s.io/kubernetes/pkg/kubelet/apis/cri"
-	criapi "k8s.io/kubernetes/pkg/kubelet/apis/cri/runtime/v1alpha2"
-	"k8s.io/kubernetes/pkg/kubelet/remote"
 	"k8s.io/kubernetes/third_party/forked/golang/expansion"
 	"net/http"
 	"runtime"
-	"strings"
 	"time"
 )
 
@@ -25,61 +22,112 @@ const (
 	containerName = "istio-proxy"
 )
 
+// criVersion controls which CRI dialect CRIRuntime negotiates with the
+// container runtime. "auto" probes the runtime and prefers v1, falling
+// back to v1alpha2 for older runtimes.
+var criVersion = flag.String("cri-version", "auto", "CRI protocol version to use when talking to the container runtime: auto, v1 or v1alpha2")
+
 type CRIRuntime struct {
-	runtimeService cri.RuntimeService
-	imageService   cri.ImageManagerService
-	httpClient     http.Client
+	adapter      criAdapter
+	endpoint     string
+	httpClient   http.Client
+	authResolver *imagePullAuthResolver
+	kubeClient   kubernetes.Interface
 }
 
-func NewCRIRuntime() (*CRIRuntime, error) {
-	runtimeService, err := remote.NewRemoteRuntimeService(getRemoteRuntimeEndpoint(), 2*time.Minute)
+// NewCRIRuntime returns a CRIRuntime dialing the CRI runtime at endpoint.
+// If endpoint is empty, it falls back to the platform-default dockershim
+// socket/pipe.
+func NewCRIRuntime(endpoint string) (*CRIRuntime, error) {
+	if endpoint == "" {
+		endpoint = getRemoteRuntimeEndpoint()
+	}
+	adapter, err := dialAdapter(endpoint, endpoint, *criVersion, 2*time.Minute)
 	if err != nil {
 		return nil, err
 	}
+	klog.Infof("Using CRI version %s", adapter.Version())
 
-	imageService, err := remote.NewRemoteImageService(getRemoteImageEndpoint(), 2*time.Minute)
+	kubeClient, err := newInClusterKubeClient()
 	if err != nil {
-		return nil, err
+		klog.Warningf("Could not build in-cluster kube client, continuing without one (imagePullSecrets and EnvFrom resolution will be unavailable): %v", err)
+		kubeClient = nil
 	}
 
 	return &CRIRuntime{
-		runtimeService: runtimeService,
-		imageService:   imageService,
-		httpClient:     http.Client{},
+		adapter:      adapter,
+		endpoint:     endpoint,
+		httpClient:   http.Client{},
+		authResolver: newImagePullAuthResolver(kubeClient),
+		kubeClient:   kubeClient,
 	}, nil
 }
 
+// APIVersion returns the CRI protocol version ("v1" or "v1alpha2")
+// negotiated with the container runtime.
+func (p *CRIRuntime) APIVersion() string {
+	return p.adapter.Version()
+}
+
+// Endpoint returns the CRI runtime socket this CRIRuntime dialed.
+func (p *CRIRuntime) Endpoint() string {
+	return p.endpoint
+}
+
+// DescribeProxy returns the runtime's view of the sidecar container and
+// the tail of its log file, for the GET /proxies/{podUID} diagnostics
+// endpoint.
+func (p *CRIRuntime) DescribeProxy(containerID string, tailLines int) (*api.ContainerStatus, []string, error) {
+	status, err := p.adapter.ContainerStatus(containerID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	logs, err := tailFile(status.LogPath, tailLines)
+	if err != nil {
+		klog.Warningf("Could not read log tail for container %s: %v", containerID, err)
+	}
+
+	return status, logs, nil
+}
+
 func (p *CRIRuntime) StartProxy(request *api.StartRequest) error {
+	err := p.startProxy(request)
+	if err != nil {
+		globalRegistry.recordFailed(request.PodUID, err.Error())
+	}
+	return err
+}
+
+func (p *CRIRuntime) startProxy(request *api.StartRequest) error {
 
 	klog.Infof("Mesh config: %v", request.MeshConfig)
 	klog.Infof("Sidecar template: %v", request.SidecarTemplate)
 	klog.Infof("Pod JSON: %v", request.PodJSON)
 
-	pod := v1.Pod{}
-	err := json.Unmarshal([]byte(request.PodJSON), &pod)
+	pod, err := unmarshalPod(request.PodJSON, request.PodIP)
 	if err != nil {
-		return fmt.Errorf("Could not unmarshal pod YAML: %v", err)
+		return err
 	}
-	pod.Status.PodIP = request.PodIP // we set it, because it's not set in the YAML yet
 
 	sidecar, err := getSidecar(request, pod)
 	if err != nil {
 		return fmt.Errorf("Could not obtain sidecar: %v", err)
 	}
 
-	err = p.pullImageIfNecessary(sidecar.Image)
+	globalRegistry.recordStarting(request.PodUID, request.PodName, request.PodNamespace, request.PodSandboxID, sidecar.Image)
+
+	err = p.pullImageIfNecessary(sidecar.Image, request.PodNamespace, request.ImagePullSecrets)
 	if err != nil {
 		return fmt.Errorf("Could not pull image %s: %v", sidecar.Image, err)
 	}
 
-	status, err := p.runtimeService.PodSandboxStatus(request.PodSandboxID)
+	sandboxMetadata, err := p.adapter.PodSandboxStatus(request.PodSandboxID)
 	if err != nil {
 		return fmt.Errorf("Error getting pod sandbox status: %v", err)
 	}
 
-	podSandboxConfig := criapi.PodSandboxConfig{
-		Metadata: status.GetMetadata(),
-	}
+	podSandboxConfig := api.PodSandboxConfig{Metadata: sandboxMetadata}
 
 	klog.Info("Creating volumes")
 	secretDir, confDir, err := createVolumes()
@@ -93,83 +141,48 @@ func (p *CRIRuntime) StartProxy(request *api.StartRequest) error {
 		return fmt.Errorf("Error writing secret data: %v", err)
 	}
 
-	envs, err := convertEnvs(&pod, sidecar.Env, sidecar.EnvFrom)
+	sidecar.Name = containerName
+	sidecarPod := kube.BuildSidecarPod(pod, *sidecar)
+
+	containerConfig, volumeDirs, err := kube.PodToContainerConfig(p.kubeClient, sidecarPod)
 	if err != nil {
-		return fmt.Errorf("Error converting env vars: %v", err)
+		return fmt.Errorf("Could not translate sidecar pod to container config: %v", err)
 	}
+	globalRegistry.recordVolumeDirs(request.PodUID, volumeDirs)
 
-	expandVars(sidecar.Command, envs)
-	expandVars(sidecar.Args, envs)
+	expandVars(containerConfig.Command, containerConfig.Envs)
+	expandVars(containerConfig.Args, containerConfig.Envs)
 
-	containerConfig := criapi.ContainerConfig{
-		Metadata: &criapi.ContainerMetadata{
-			Name: containerName,
+	containerConfig.Mounts = append(containerConfig.Mounts,
+		&api.Mount{
+			ContainerPath: "/etc/istio/proxy/",
+			HostPath:      confDir,
+			Readonly:      false,
 		},
-		Image: &criapi.ImageSpec{
-			Image: sidecar.Image,
+		&api.Mount{
+			ContainerPath: "/etc/certs/",
+			HostPath:      secretDir,
+			Readonly:      true,
 		},
-		Command: sidecar.Command,
-		Args:    sidecar.Args,
-		Linux: &criapi.LinuxContainerConfig{
-			Resources: &criapi.LinuxContainerResources{
-				// TODO
-			},
-			SecurityContext: &criapi.LinuxContainerSecurityContext{
-				RunAsUser:          &criapi.Int64Value{*sidecar.SecurityContext.RunAsUser},
-				SupplementalGroups: []int64{0},
-				Privileged:         true,
-			},
-		},
-		Windows: &criapi.WindowsContainerConfig{
-			Resources: &criapi.WindowsContainerResources{
-				// TODO
-			},
-			SecurityContext: &criapi.WindowsContainerSecurityContext{
-				RunAsUsername: "NotImplemented", // TODO
-			},
-		},
-		Envs: envs,
-		Mounts: []*criapi.Mount{
-			{
-				ContainerPath: "/etc/istio/proxy/",
-				HostPath:      confDir,
-				Readonly:      false,
-			},
-			{
-				ContainerPath: "/etc/certs/",
-				HostPath:      secretDir,
-				Readonly:      true,
-			},
-		},
-		Labels: map[string]string{
-			"io.kubernetes.container.name": containerName,
-			"io.kubernetes.pod.name":       request.PodName,
-			"io.kubernetes.pod.namespace":  request.PodNamespace,
-			"io.kubernetes.pod.uid":        request.PodUID,
-		},
-		Annotations: map[string]string{
-			"io.kubernetes.container.terminationMessagePath":   "/dev/termination-log",
-			"io.kubernetes.container.terminationMessagePolicy": "File",
-			"io.kubernetes.container.hash":                     "0", // TODO
-			"io.kubernetes.container.restartCount":             "0", // TODO
-		},
-	}
+	)
 
 	klog.Infof("containerConfig: %v", toDebugJSON(containerConfig))
 
 	klog.Infof("Creating proxy sidecar container for pod %s", request.PodName)
-	containerID, err := p.runtimeService.CreateContainer(request.PodSandboxID, &containerConfig, &podSandboxConfig)
+	containerID, err := p.adapter.CreateContainer(request.PodSandboxID, containerConfig, &podSandboxConfig)
 	if err != nil {
 		return fmt.Errorf("Error creating sidecar container: %v", err)
 	}
 	klog.Infof("Created proxy sidecar container: %s", containerID)
 
-	err = p.runtimeService.StartContainer(containerID)
+	err = p.adapter.StartContainer(containerID)
 	if err != nil {
 		return fmt.Errorf("Error starting sidecar container: %v", err)
 	}
 	klog.Infof("Started proxy sidecar container: %s", containerID)
 
+	globalRegistry.recordStarted(request.PodUID, containerID)
+
 	return nil
 }
 
@@ -192,7 +205,7 @@ func getSidecar(request *api.StartRequest, pod v1.Pod) (*v1.Container, error) {
 	return &sidecarInjectionSpec.Containers[0], nil
 }
 
-func expandVars(strings []string, envVars []*criapi.KeyValue) {
+func expandVars(strings []string, envVars []*api.KeyValue) {
 	mappingFunc := expansion.MappingFuncFor(EnvVarsToMap(envVars))
 
 	for i, s := range strings {
@@ -200,7 +213,7 @@ func expandVars(strings []string, envVars []*criapi.KeyValue) {
 	}
 }
 
-func EnvVarsToMap(envs []*criapi.KeyValue) map[string]string {
+func EnvVarsToMap(envs []*api.KeyValue) map[string]string {
 	result := map[string]string{}
 	for _, env := range envs {
 		result[env.Key] = env.Value
@@ -214,61 +227,26 @@ func sidecarTemplateVersionHash(in string) string {
 	return hex.EncodeToString(hash[:])
 }
 
-func convertEnvs(pod *v1.Pod, env []v1.EnvVar, envFromSources []v1.EnvFromSource) ([]*criapi.KeyValue, error) {
-	if len(envFromSources) > 0 {
-		return nil, fmt.Errorf("EnvFrom not supported")
-	}
-
-	r := []*criapi.KeyValue{}
-
-	tmpEnv := make(map[string]string)
-	mappingFunc := expansion.MappingFuncFor(tmpEnv)
-
-	for _, e := range env {
-		value := e.Value
-
-		if e.ValueFrom != nil && e.ValueFrom.FieldRef != nil {
-			fieldRef := e.ValueFrom.FieldRef
-			switch {
-			case fieldRef.FieldPath == "metadata.uid":
-				value = string(pod.UID)
-			case fieldRef.FieldPath == "metadata.name":
-				value = pod.Name
-			case fieldRef.FieldPath == "metadata.namespace":
-				value = pod.Namespace
-			case fieldRef.FieldPath == "status.podIP":
-				value = pod.Status.PodIP
-			}
-		}
-
-		value = expansion.Expand(value, mappingFunc)
-
-		tmpEnv[e.Name] = value
-		r = append(r, &criapi.KeyValue{
-			Key:   e.Name,
-			Value: value,
-		})
-	}
-
-	return r, nil
-}
-
-func (p *CRIRuntime) pullImageIfNecessary(image string) error {
+func (p *CRIRuntime) pullImageIfNecessary(image, namespace string, imagePullSecrets []string) error {
 	klog.Infof("Checking if image %s is available locally", image)
 
-	imageSpec := criapi.ImageSpec{
-		Image: image,
-	}
-	imageStatus, err := p.imageService.ImageStatus(&imageSpec)
+	present, err := p.adapter.ImageStatus(image)
 	if err != nil {
 		return fmt.Errorf("Error getting image status: %v", err)
 	}
 
-	if imageStatus == nil {
-		klog.Infof("Pulling image %s is available locally", image)
-		var authConfig *criapi.AuthConfig = nil // TODO: implement image pull authentication
-		imageRef, err := p.imageService.PullImage(&imageSpec, authConfig)
+	if !present {
+		auth, resolveErr := p.authResolver.resolve(namespace, imagePullSecrets, image)
+		if resolveErr != nil {
+			klog.Infof("No registry credentials resolved for image %s, attempting anonymous pull: %v", image, resolveErr)
+		}
+
+		klog.Infof("Pulling image %s", image)
+		imageRef, err := p.adapter.PullImage(image, auth)
 		if err != nil {
+			if auth == nil && resolveErr != nil {
+				return fmt.Errorf("Error pulling image: %v (%v)", err, resolveErr)
+			}
 			return fmt.Errorf("Error pulling image: %v", err)
 		}
 		klog.Infof("Successfully pulled image. Image ref: %s", imageRef)
@@ -279,10 +257,6 @@ func (p *CRIRuntime) pullImageIfNecessary(image string) error {
 	return nil
 }
 
-func getRemoteImageEndpoint() string {
-	return getRemoteRuntimeEndpoint()
-}
-
 func getRemoteRuntimeEndpoint() string {
 	if runtime.GOOS == "linux" {
 		return "unix:///var/run/dockershim.sock"
@@ -299,49 +273,27 @@ func (p *CRIRuntime) StopProxy(request *api.StopRequest) error {
 		return err
 	}
 
-	err = p.runtimeService.StopContainer(containerID, 30000) // TODO: make timeout configurable
+	err = p.adapter.StopContainer(containerID, 30000) // TODO: make timeout configurable
 	if err != nil {
 		return err
 	}
 
+	removeVolumeDirs(request.PodUID)
+	globalRegistry.recordStopped(request.PodUID)
+
 	return nil
 }
 
-func (p *CRIRuntime) IsReady(request *api.ReadinessRequest) (bool, error) {
-	ready := false
-
-	netNS := strings.Replace(request.NetNS, "/proc/", "/hostproc/", 1) // we're running in a container; host's /proc/ is mapped to /hostproc/
-
-	err := ns.WithNetNSPath(netNS, func(hostNS ns.NetNS) error {
-		//url := "http://" + request.PodIP + ":" + "15000" + "/server_info" // TODO: make port & path configurable
-		url := "http://" + "localhost" + ":" + "15000" + "/server_info" // TODO: make port & path configurable
-		req, err := http.NewRequest(http.MethodGet, url, nil)
-		if err != nil {
-			return err
-		}
-
-		response, err := p.httpClient.Do(req)
-		if err != nil {
-			return err
-		}
-		defer response.Body.Close()
-
-		if response.StatusCode >= http.StatusOK && response.StatusCode < http.StatusBadRequest {
-			klog.Infof("Readiness probe succeeded for %s", request.PodName)
-			ready = true
-			return nil
-		}
-		klog.Infof("Readiness probe failed for %s (%s): %v %s", request.PodName, url, response.StatusCode, response.Status)
-		return nil
-	})
-
-	return ready, err
+func (p *CRIRuntime) IsReady(request *api.ReadinessRequest) (*ReadinessResult, error) {
+	result, err := checkReadiness(&p.httpClient, request)
+	if err == nil {
+		globalRegistry.recordReadiness(request.PodUID, *result)
+	}
+	return result, err
 }
 
 func (p *CRIRuntime) findProxyContainerID(podSandboxId string) (string, error) {
-	containers, err := p.runtimeService.ListContainers(&criapi.ContainerFilter{
-		PodSandboxId: podSandboxId,
-	})
+	containers, err := p.adapter.ListContainers(podSandboxId)
 	if err != nil {
 		return "", err
 	}
@@ -354,11 +306,11 @@ func (p *CRIRuntime) findProxyContainerID(podSandboxId string) (string, error) {
 	return container.Id, nil
 }
 
-func (p *CRIRuntime) findContainerByName(name string, containers []*criapi.Container) (*criapi.Container, error) {
+func (p *CRIRuntime) findContainerByName(name string, containers []*api.Container) (*api.Container, error) {
 	for _, c := range containers {
 		if c.Metadata.Name == name {
 			return c, nil
 		}
 	}
 	return nil, fmt.Errorf("Could not find container %q in list of containers", containerName)
-}
\ No newline at end of file
+}
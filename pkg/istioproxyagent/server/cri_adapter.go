@@ -0,0 +1,406 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"istio.io/cni/pkg/istioproxyagent/api"
+	"k8s.io/klog"
+
+	criapiv1 "k8s.io/cri-api/pkg/apis/runtime/v1"
+	v1internalapi "k8s.io/cri-client/pkg/apis"
+	v1remote "k8s.io/cri-client/pkg/remote"
+	v1alpha2internalapi "k8s.io/kubernetes/pkg/kubelet/apis/cri"
+	criapi "k8s.io/kubernetes/pkg/kubelet/apis/cri/runtime/v1alpha2"
+	v1alpha2remote "k8s.io/kubernetes/pkg/kubelet/remote"
+)
+
+// criAdapter translates between the version-neutral types in the api
+// package and whichever CRI dialect CRIRuntime negotiated with the
+// container runtime at dial time. Exactly one of v1Adapter or
+// v1alpha2Adapter backs a given CRIRuntime.
+type criAdapter interface {
+	Version() string
+	PodSandboxStatus(podSandboxID string) (*api.PodSandboxMetadata, error)
+	ContainerStatus(containerID string) (*api.ContainerStatus, error)
+	CreateContainer(podSandboxID string, config *api.ContainerConfig, sandboxConfig *api.PodSandboxConfig) (string, error)
+	StartContainer(containerID string) error
+	StopContainer(containerID string, timeoutSeconds int64) error
+	ListContainers(podSandboxID string) ([]*api.Container, error)
+	ImageStatus(image string) (bool, error)
+	PullImage(image string, auth *api.AuthConfig) (string, error)
+}
+
+// dialAdapter negotiates the CRI protocol version against runtimeEndpoint
+// and returns an adapter for whichever dialect it speaks. forcedVersion
+// may be "auto", "v1" or "v1alpha2" (the values accepted by the
+// --cri-version flag); "auto" probes runtime.v1.RuntimeService/Version
+// first and falls back to v1alpha2 if the runtime returns Unimplemented.
+func dialAdapter(runtimeEndpoint, imageEndpoint, forcedVersion string, timeout time.Duration) (criAdapter, error) {
+	version := forcedVersion
+	if version == "" || version == "auto" {
+		var err error
+		version, err = probeCRIVersion(runtimeEndpoint, timeout)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch version {
+	case "v1":
+		runtimeService, err := v1remote.NewRemoteRuntimeService(runtimeEndpoint, timeout)
+		if err != nil {
+			return nil, err
+		}
+		imageService, err := v1remote.NewRemoteImageService(imageEndpoint, timeout)
+		if err != nil {
+			return nil, err
+		}
+		return &v1Adapter{runtimeService: runtimeService, imageService: imageService}, nil
+	case "v1alpha2":
+		runtimeService, err := v1alpha2remote.NewRemoteRuntimeService(runtimeEndpoint, timeout)
+		if err != nil {
+			return nil, err
+		}
+		imageService, err := v1alpha2remote.NewRemoteImageService(imageEndpoint, timeout)
+		if err != nil {
+			return nil, err
+		}
+		return &v1alpha2Adapter{runtimeService: runtimeService, imageService: imageService}, nil
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "unknown CRI version %q", version)
+	}
+}
+
+// probeCRIVersion dials runtimeEndpoint and calls
+// runtime.v1.RuntimeService/Version to check whether the runtime
+// understands CRI v1. If the runtime responds Unimplemented, it falls
+// back to v1alpha2; any other error is returned to the caller.
+func probeCRIVersion(runtimeEndpoint string, timeout time.Duration) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	conn, err := grpc.DialContext(ctx, runtimeEndpoint, grpc.WithInsecure(), grpc.WithBlock())
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	client := criapiv1.NewRuntimeServiceClient(conn)
+	_, err = client.Version(ctx, &criapiv1.VersionRequest{})
+	if err == nil {
+		klog.Info("Container runtime speaks CRI v1")
+		return "v1", nil
+	}
+	if status.Code(err) == codes.Unimplemented {
+		klog.Info("Container runtime does not implement CRI v1, falling back to v1alpha2")
+		return "v1alpha2", nil
+	}
+	return "", err
+}
+
+// v1alpha2Adapter speaks the legacy runtime.v1alpha2 dialect. It is kept
+// around for container runtimes that predate CRI v1 (containerd <1.6,
+// CRI-O <1.26).
+type v1alpha2Adapter struct {
+	runtimeService v1alpha2internalapi.RuntimeService
+	imageService   v1alpha2internalapi.ImageManagerService
+}
+
+func (a *v1alpha2Adapter) Version() string { return "v1alpha2" }
+
+func (a *v1alpha2Adapter) PodSandboxStatus(podSandboxID string) (*api.PodSandboxMetadata, error) {
+	status, err := a.runtimeService.PodSandboxStatus(podSandboxID)
+	if err != nil {
+		return nil, err
+	}
+	meta := status.GetMetadata()
+	return &api.PodSandboxMetadata{
+		Name:      meta.GetName(),
+		Uid:       meta.GetUid(),
+		Namespace: meta.GetNamespace(),
+		Attempt:   meta.GetAttempt(),
+	}, nil
+}
+
+func (a *v1alpha2Adapter) ContainerStatus(containerID string) (*api.ContainerStatus, error) {
+	status, err := a.runtimeService.ContainerStatus(containerID)
+	if err != nil {
+		return nil, err
+	}
+	return &api.ContainerStatus{
+		State:    status.GetState().String(),
+		Image:    status.GetImage().GetImage(),
+		LogPath:  status.GetLogPath(),
+		ExitCode: status.GetExitCode(),
+		Reason:   status.GetReason(),
+	}, nil
+}
+
+func (a *v1alpha2Adapter) CreateContainer(podSandboxID string, config *api.ContainerConfig, sandboxConfig *api.PodSandboxConfig) (string, error) {
+	return a.runtimeService.CreateContainer(podSandboxID, toV1Alpha2ContainerConfig(config), toV1Alpha2PodSandboxConfig(sandboxConfig))
+}
+
+func (a *v1alpha2Adapter) StartContainer(containerID string) error {
+	return a.runtimeService.StartContainer(containerID)
+}
+
+func (a *v1alpha2Adapter) StopContainer(containerID string, timeoutSeconds int64) error {
+	return a.runtimeService.StopContainer(containerID, timeoutSeconds)
+}
+
+func (a *v1alpha2Adapter) ListContainers(podSandboxID string) ([]*api.Container, error) {
+	containers, err := a.runtimeService.ListContainers(&criapi.ContainerFilter{PodSandboxId: podSandboxID})
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*api.Container, 0, len(containers))
+	for _, c := range containers {
+		result = append(result, &api.Container{Id: c.Id, Metadata: &api.ContainerMetadata{Name: c.Metadata.GetName()}})
+	}
+	return result, nil
+}
+
+func (a *v1alpha2Adapter) ImageStatus(image string) (bool, error) {
+	status, err := a.imageService.ImageStatus(&criapi.ImageSpec{Image: image})
+	if err != nil {
+		return false, err
+	}
+	return status != nil, nil
+}
+
+func (a *v1alpha2Adapter) PullImage(image string, auth *api.AuthConfig) (string, error) {
+	return a.imageService.PullImage(&criapi.ImageSpec{Image: image}, toV1Alpha2AuthConfig(auth))
+}
+
+func toV1Alpha2AuthConfig(auth *api.AuthConfig) *criapi.AuthConfig {
+	if auth == nil {
+		return nil
+	}
+	return &criapi.AuthConfig{
+		Username:      auth.Username,
+		Password:      auth.Password,
+		Auth:          auth.Auth,
+		ServerAddress: auth.ServerAddress,
+		IdentityToken: auth.IdentityToken,
+	}
+}
+
+func toV1Alpha2ContainerConfig(config *api.ContainerConfig) *criapi.ContainerConfig {
+	out := &criapi.ContainerConfig{
+		Metadata:    &criapi.ContainerMetadata{Name: config.Metadata.Name},
+		Image:       &criapi.ImageSpec{Image: config.Image.Image},
+		Command:     config.Command,
+		Args:        config.Args,
+		Labels:      config.Labels,
+		Annotations: config.Annotations,
+	}
+	for _, e := range config.Envs {
+		out.Envs = append(out.Envs, &criapi.KeyValue{Key: e.Key, Value: e.Value})
+	}
+	for _, m := range config.Mounts {
+		out.Mounts = append(out.Mounts, &criapi.Mount{ContainerPath: m.ContainerPath, HostPath: m.HostPath, Readonly: m.Readonly})
+	}
+	if config.Security != nil {
+		sc := &criapi.LinuxContainerSecurityContext{
+			SupplementalGroups: config.Security.SupplementalGroups,
+			Privileged:         config.Security.Privileged,
+			ReadonlyRootfs:     config.Security.ReadonlyRootfs,
+		}
+		if config.Security.RunAsUser != nil {
+			sc.RunAsUser = &criapi.Int64Value{Value: *config.Security.RunAsUser}
+		}
+		if config.Security.Capabilities != nil {
+			sc.Capabilities = &criapi.Capability{
+				AddCapabilities:  config.Security.Capabilities.AddCapabilities,
+				DropCapabilities: config.Security.Capabilities.DropCapabilities,
+			}
+		}
+		out.Linux = &criapi.LinuxContainerConfig{
+			Resources:       toV1Alpha2Resources(config.Resources),
+			SecurityContext: sc,
+		}
+	}
+	return out
+}
+
+func toV1Alpha2PodSandboxConfig(config *api.PodSandboxConfig) *criapi.PodSandboxConfig {
+	if config == nil || config.Metadata == nil {
+		return &criapi.PodSandboxConfig{}
+	}
+	return &criapi.PodSandboxConfig{
+		Metadata: &criapi.PodSandboxMetadata{
+			Name:      config.Metadata.Name,
+			Uid:       config.Metadata.Uid,
+			Namespace: config.Metadata.Namespace,
+			Attempt:   config.Metadata.Attempt,
+		},
+	}
+}
+
+func toV1Alpha2Resources(r *api.LinuxContainerResources) *criapi.LinuxContainerResources {
+	if r == nil {
+		return &criapi.LinuxContainerResources{}
+	}
+	return &criapi.LinuxContainerResources{
+		CpuPeriod:          r.CpuPeriod,
+		CpuQuota:           r.CpuQuota,
+		CpuShares:          r.CpuShares,
+		MemoryLimitInBytes: r.MemoryLimitInBytes,
+		OomScoreAdj:        r.OomScoreAdj,
+	}
+}
+
+// v1Adapter speaks the current runtime.v1 dialect, used by containerd
+// 1.6+ and CRI-O 1.26+.
+type v1Adapter struct {
+	runtimeService v1internalapi.RuntimeService
+	imageService   v1internalapi.ImageManagerService
+}
+
+func (a *v1Adapter) Version() string { return "v1" }
+
+func (a *v1Adapter) PodSandboxStatus(podSandboxID string) (*api.PodSandboxMetadata, error) {
+	status, err := a.runtimeService.PodSandboxStatus(podSandboxID)
+	if err != nil {
+		return nil, err
+	}
+	meta := status.GetMetadata()
+	return &api.PodSandboxMetadata{
+		Name:      meta.GetName(),
+		Uid:       meta.GetUid(),
+		Namespace: meta.GetNamespace(),
+		Attempt:   meta.GetAttempt(),
+	}, nil
+}
+
+func (a *v1Adapter) ContainerStatus(containerID string) (*api.ContainerStatus, error) {
+	status, err := a.runtimeService.ContainerStatus(containerID)
+	if err != nil {
+		return nil, err
+	}
+	return &api.ContainerStatus{
+		State:    status.GetState().String(),
+		Image:    status.GetImage().GetImage(),
+		LogPath:  status.GetLogPath(),
+		ExitCode: status.GetExitCode(),
+		Reason:   status.GetReason(),
+	}, nil
+}
+
+func (a *v1Adapter) CreateContainer(podSandboxID string, config *api.ContainerConfig, sandboxConfig *api.PodSandboxConfig) (string, error) {
+	return a.runtimeService.CreateContainer(podSandboxID, toV1ContainerConfig(config), toV1PodSandboxConfig(sandboxConfig))
+}
+
+func (a *v1Adapter) StartContainer(containerID string) error {
+	return a.runtimeService.StartContainer(containerID)
+}
+
+func (a *v1Adapter) StopContainer(containerID string, timeoutSeconds int64) error {
+	return a.runtimeService.StopContainer(containerID, timeoutSeconds)
+}
+
+func (a *v1Adapter) ListContainers(podSandboxID string) ([]*api.Container, error) {
+	containers, err := a.runtimeService.ListContainers(&criapiv1.ContainerFilter{PodSandboxId: podSandboxID})
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*api.Container, 0, len(containers))
+	for _, c := range containers {
+		result = append(result, &api.Container{Id: c.Id, Metadata: &api.ContainerMetadata{Name: c.Metadata.GetName()}})
+	}
+	return result, nil
+}
+
+func (a *v1Adapter) ImageStatus(image string) (bool, error) {
+	status, err := a.imageService.ImageStatus(&criapiv1.ImageSpec{Image: image})
+	if err != nil {
+		return false, err
+	}
+	return status != nil, nil
+}
+
+func (a *v1Adapter) PullImage(image string, auth *api.AuthConfig) (string, error) {
+	return a.imageService.PullImage(&criapiv1.ImageSpec{Image: image}, toV1AuthConfig(auth))
+}
+
+func toV1AuthConfig(auth *api.AuthConfig) *criapiv1.AuthConfig {
+	if auth == nil {
+		return nil
+	}
+	return &criapiv1.AuthConfig{
+		Username:      auth.Username,
+		Password:      auth.Password,
+		Auth:          auth.Auth,
+		ServerAddress: auth.ServerAddress,
+		IdentityToken: auth.IdentityToken,
+	}
+}
+
+func toV1ContainerConfig(config *api.ContainerConfig) *criapiv1.ContainerConfig {
+	out := &criapiv1.ContainerConfig{
+		Metadata:    &criapiv1.ContainerMetadata{Name: config.Metadata.Name},
+		Image:       &criapiv1.ImageSpec{Image: config.Image.Image},
+		Command:     config.Command,
+		Args:        config.Args,
+		Labels:      config.Labels,
+		Annotations: config.Annotations,
+	}
+	for _, e := range config.Envs {
+		out.Envs = append(out.Envs, &criapiv1.KeyValue{Key: e.Key, Value: e.Value})
+	}
+	for _, m := range config.Mounts {
+		out.Mounts = append(out.Mounts, &criapiv1.Mount{ContainerPath: m.ContainerPath, HostPath: m.HostPath, Readonly: m.Readonly})
+	}
+	if config.Security != nil {
+		sc := &criapiv1.LinuxContainerSecurityContext{
+			SupplementalGroups: config.Security.SupplementalGroups,
+			Privileged:         config.Security.Privileged,
+			ReadonlyRootfs:     config.Security.ReadonlyRootfs,
+		}
+		if config.Security.RunAsUser != nil {
+			sc.RunAsUser = &criapiv1.Int64Value{Value: *config.Security.RunAsUser}
+		}
+		if config.Security.Capabilities != nil {
+			sc.Capabilities = &criapiv1.Capability{
+				AddCapabilities:  config.Security.Capabilities.AddCapabilities,
+				DropCapabilities: config.Security.Capabilities.DropCapabilities,
+			}
+		}
+		out.Linux = &criapiv1.LinuxContainerConfig{
+			Resources:       toV1Resources(config.Resources),
+			SecurityContext: sc,
+		}
+	}
+	return out
+}
+
+func toV1PodSandboxConfig(config *api.PodSandboxConfig) *criapiv1.PodSandboxConfig {
+	if config == nil || config.Metadata == nil {
+		return &criapiv1.PodSandboxConfig{}
+	}
+	return &criapiv1.PodSandboxConfig{
+		Metadata: &criapiv1.PodSandboxMetadata{
+			Name:      config.Metadata.Name,
+			Uid:       config.Metadata.Uid,
+			Namespace: config.Metadata.Namespace,
+			Attempt:   config.Metadata.Attempt,
+		},
+	}
+}
+
+func toV1Resources(r *api.LinuxContainerResources) *criapiv1.LinuxContainerResources {
+	if r == nil {
+		return &criapiv1.LinuxContainerResources{}
+	}
+	return &criapiv1.LinuxContainerResources{
+		CpuPeriod:          r.CpuPeriod,
+		CpuQuota:           r.CpuQuota,
+		CpuShares:          r.CpuShares,
+		MemoryLimitInBytes: r.MemoryLimitInBytes,
+		OomScoreAdj:        r.OomScoreAdj,
+	}
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	"istio.io/cni/pkg/istioproxyagent/api"
+	"k8s.io/klog"
+)
+
+// agentVersion is stamped by the build via -ldflags -X, mirroring how
+// istio's other binaries report their version.
+var agentVersion = "unknown"
+
+const defaultInfoSocket = "/var/run/istio-proxy-agent.sock"
+const defaultLogTailLines = 200
+
+var infoSocket = flag.String("info-socket", defaultInfoSocket, "Unix socket to bind the read-only diagnostics API (GET /info, /proxies) to")
+
+// InfoServer exposes a read-only diagnostics API over a unix socket, so
+// operators can inspect why a pod's sidecar is unhealthy without SSHing
+// to the node. pkg/istioproxyagent/client provides a Go client for it.
+type InfoServer struct {
+	runtime   ProxyRuntime
+	registry  *proxyRegistry
+	startedAt time.Time
+}
+
+// NewInfoServer returns an InfoServer that reports on runtime and the
+// sidecars tracked by the shared proxy registry.
+func NewInfoServer(runtime ProxyRuntime) *InfoServer {
+	return &InfoServer{
+		runtime:   runtime,
+		registry:  globalRegistry,
+		startedAt: time.Now(),
+	}
+}
+
+// ListenAndServe binds the configured unix socket and serves the
+// diagnostics API until the process exits or an unrecoverable error
+// occurs.
+func (s *InfoServer) ListenAndServe() error {
+	socket := *infoSocket
+	if err := os.RemoveAll(socket); err != nil {
+		return fmt.Errorf("Could not remove stale socket %s: %v", socket, err)
+	}
+
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return fmt.Errorf("Could not bind diagnostics socket %s: %v", socket, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/info", s.handleInfo)
+	mux.HandleFunc("/proxies", s.handleProxies)
+	mux.HandleFunc("/proxies/", s.handleProxyDetail)
+
+	klog.Infof("Serving diagnostics API on unix socket %s", socket)
+	return http.Serve(listener, mux)
+}
+
+func (s *InfoServer) handleInfo(w http.ResponseWriter, r *http.Request) {
+	started, stopped, failed := s.registry.counts()
+	writeJSON(w, &api.InfoResponse{
+		Version:           agentVersion,
+		RuntimeEndpoint:   s.runtime.Endpoint(),
+		RuntimeAPIVersion: s.runtime.APIVersion(),
+		GOOS:              runtime.GOOS,
+		UptimeSeconds:     time.Since(s.startedAt).Seconds(),
+		ProxiesStarted:    started,
+		ProxiesStopped:    stopped,
+		ProxiesFailed:     failed,
+	})
+}
+
+func (s *InfoServer) handleProxies(w http.ResponseWriter, r *http.Request) {
+	infos := s.registry.list()
+	summaries := make([]*api.ProxySummary, 0, len(infos))
+	for _, info := range infos {
+		summaries = append(summaries, toProxySummary(info))
+	}
+	writeJSON(w, summaries)
+}
+
+func (s *InfoServer) handleProxyDetail(w http.ResponseWriter, r *http.Request) {
+	podUID := strings.TrimPrefix(r.URL.Path, "/proxies/")
+	if podUID == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	info, ok := s.registry.get(podUID)
+	if !ok {
+		http.Error(w, fmt.Sprintf("no known proxy for pod %q", podUID), http.StatusNotFound)
+		return
+	}
+
+	detail := &api.ProxyDetail{ProxySummary: *toProxySummary(info)}
+
+	if info.ContainerID != "" {
+		status, logs, err := s.runtime.DescribeProxy(info.ContainerID, defaultLogTailLines)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not describe container %s: %v", info.ContainerID, err), http.StatusBadGateway)
+			return
+		}
+		detail.ContainerState = status.State
+		detail.ExitCode = status.ExitCode
+		detail.Reason = status.Reason
+		detail.Logs = logs
+	}
+
+	writeJSON(w, detail)
+}
+
+func toProxySummary(info *ProxyInfo) *api.ProxySummary {
+	summary := &api.ProxySummary{
+		PodUID:       info.PodUID,
+		PodName:      info.PodName,
+		PodNamespace: info.PodNamespace,
+		PodSandboxID: info.PodSandboxID,
+		ContainerID:  info.ContainerID,
+		Image:        info.Image,
+		State:        string(info.State),
+		LastError:    info.LastError,
+	}
+	if info.LastReadiness != nil {
+		ready := info.LastReadiness.Ready
+		checkedAt := info.LastReadiness.CheckedAt
+		latencyMs := info.LastReadiness.Latency.Milliseconds()
+		summary.LastReady = &ready
+		summary.LastCheckedAt = &checkedAt
+		summary.LastLatencyMs = &latencyMs
+	}
+	return summary
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		klog.Errorf("Error encoding diagnostics response: %v", err)
+	}
+}
@@ -0,0 +1,445 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"istio.io/cni/pkg/istioproxyagent/api"
+	"istio.io/cni/pkg/istioproxyagent/kube"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+)
+
+const (
+	libpodAPIVersion = "v4.0.0"
+)
+
+// PodmanRuntime drives Podman's libpod REST API over a unix socket to
+// start and stop the istio-proxy sidecar. It is used on hosts that have
+// replaced dockershim with Podman/crun and therefore don't expose a CRI
+// socket.
+type PodmanRuntime struct {
+	endpoint     string
+	httpClient   http.Client
+	authResolver *imagePullAuthResolver
+	kubeClient   kubernetes.Interface
+}
+
+// NewPodmanRuntime returns a PodmanRuntime talking to the libpod REST
+// API at endpoint, e.g. "unix:///run/podman/podman.sock".
+func NewPodmanRuntime(endpoint string) (*PodmanRuntime, error) {
+	socket, err := socketPath(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}
+
+	kubeClient, err := newInClusterKubeClient()
+	if err != nil {
+		klog.Warningf("Could not build in-cluster kube client, continuing without one (imagePullSecrets and EnvFrom resolution will be unavailable): %v", err)
+		kubeClient = nil
+	}
+
+	return &PodmanRuntime{
+		endpoint:     endpoint,
+		httpClient:   http.Client{Transport: transport},
+		authResolver: newImagePullAuthResolver(kubeClient),
+		kubeClient:   kubeClient,
+	}, nil
+}
+
+// Endpoint returns the Podman socket this PodmanRuntime talks to.
+func (p *PodmanRuntime) Endpoint() string {
+	return p.endpoint
+}
+
+// APIVersion identifies this backend to the diagnostics API; Podman has
+// no CRI dialect to negotiate.
+func (p *PodmanRuntime) APIVersion() string {
+	return "podman"
+}
+
+func socketPath(endpoint string) (string, error) {
+	if !strings.HasPrefix(endpoint, "unix://") {
+		return "", fmt.Errorf("unsupported runtime endpoint %q: only unix:// sockets are supported", endpoint)
+	}
+	return strings.TrimPrefix(endpoint, "unix://"), nil
+}
+
+// podmanNamespaces holds the namespace paths of the pod's infra
+// container, as reported by podman inspect. The sidecar container is
+// created to join them so it shares the pod's network, IPC and UTS
+// namespaces.
+type podmanNamespaces struct {
+	Net string
+	IPC string
+	UTS string
+}
+
+func (p *PodmanRuntime) StartProxy(request *api.StartRequest) error {
+	err := p.startProxy(request)
+	if err != nil {
+		globalRegistry.recordFailed(request.PodUID, err.Error())
+	}
+	return err
+}
+
+func (p *PodmanRuntime) startProxy(request *api.StartRequest) error {
+	klog.Infof("Starting proxy for pod %s via Podman", request.PodName)
+
+	namespaces, err := p.inspectNamespaces(request.PodSandboxID)
+	if err != nil {
+		return fmt.Errorf("Error inspecting pod sandbox %s: %v", request.PodSandboxID, err)
+	}
+
+	pod, err := unmarshalPod(request.PodJSON, request.PodIP)
+	if err != nil {
+		return err
+	}
+
+	sidecar, err := getSidecar(request, pod)
+	if err != nil {
+		return fmt.Errorf("Could not obtain sidecar: %v", err)
+	}
+
+	globalRegistry.recordStarting(request.PodUID, request.PodName, request.PodNamespace, request.PodSandboxID, sidecar.Image)
+
+	err = p.pullImageIfNecessary(sidecar.Image, request.PodNamespace, request.ImagePullSecrets)
+	if err != nil {
+		return fmt.Errorf("Could not pull image %s: %v", sidecar.Image, err)
+	}
+
+	klog.Info("Creating volumes")
+	secretDir, confDir, err := createVolumes()
+	if err != nil {
+		return fmt.Errorf("Error creating volumes: %v", err)
+	}
+
+	klog.Infof("Writing secret data to %s", secretDir)
+	err = writeSecret(secretDir, request.SecretData)
+	if err != nil {
+		return fmt.Errorf("Error writing secret data: %v", err)
+	}
+
+	sidecar.Name = containerName
+	sidecarPod := kube.BuildSidecarPod(pod, *sidecar)
+
+	containerConfig, volumeDirs, err := kube.PodToContainerConfig(p.kubeClient, sidecarPod)
+	if err != nil {
+		return fmt.Errorf("Could not translate sidecar pod to container config: %v", err)
+	}
+	globalRegistry.recordVolumeDirs(request.PodUID, volumeDirs)
+
+	expandVars(containerConfig.Command, containerConfig.Envs)
+	expandVars(containerConfig.Args, containerConfig.Envs)
+
+	containerConfig.Mounts = append(containerConfig.Mounts,
+		&api.Mount{
+			ContainerPath: "/etc/istio/proxy/",
+			HostPath:      confDir,
+			Readonly:      false,
+		},
+		&api.Mount{
+			ContainerPath: "/etc/certs/",
+			HostPath:      secretDir,
+			Readonly:      true,
+		},
+	)
+
+	createSpec := map[string]interface{}{
+		"name":    containerName + "-" + request.PodUID,
+		"image":   sidecar.Image,
+		"command": append(append([]string{}, containerConfig.Command...), containerConfig.Args...),
+		"env":     EnvVarsToMap(containerConfig.Envs),
+		"mounts":  toLibpodMounts(containerConfig.Mounts),
+		"netns":   map[string]string{"nsmode": "path", "value": namespaces.Net},
+		"ipcns":   map[string]string{"nsmode": "path", "value": namespaces.IPC},
+		"utsns":   map[string]string{"nsmode": "path", "value": namespaces.UTS},
+		"labels":  containerConfig.Labels,
+	}
+	applyLibpodSecurity(createSpec, containerConfig.Security)
+
+	var created struct {
+		Id string `json:"Id"`
+	}
+	err = p.post("/libpod/containers/create", createSpec, &created)
+	if err != nil {
+		return fmt.Errorf("Error creating sidecar container: %v", err)
+	}
+	klog.Infof("Created proxy sidecar container: %s", created.Id)
+
+	err = p.post(fmt.Sprintf("/libpod/containers/%s/start", created.Id), nil, nil)
+	if err != nil {
+		return fmt.Errorf("Error starting sidecar container: %v", err)
+	}
+	klog.Infof("Started proxy sidecar container: %s", created.Id)
+
+	globalRegistry.recordStarted(request.PodUID, created.Id)
+
+	return nil
+}
+
+// toLibpodMounts translates the version-neutral CRI mounts into the
+// libpod container-create spec's bind-mount format.
+func toLibpodMounts(mounts []*api.Mount) []map[string]interface{} {
+	result := make([]map[string]interface{}, 0, len(mounts))
+	for _, m := range mounts {
+		spec := map[string]interface{}{
+			"destination": m.ContainerPath,
+			"type":        "bind",
+			"source":      m.HostPath,
+		}
+		if m.Readonly {
+			spec["options"] = []string{"ro"}
+		}
+		result = append(result, spec)
+	}
+	return result
+}
+
+// applyLibpodSecurity sets the libpod create spec's user, privileged,
+// read-only rootfs, capability and supplemental-group fields from the
+// same LinuxContainerSecurityContext the CRI path applies, so a sidecar
+// started via Podman gets the same privileges it would under CRI.
+func applyLibpodSecurity(createSpec map[string]interface{}, security *api.LinuxContainerSecurityContext) {
+	if security == nil {
+		return
+	}
+
+	if security.RunAsUser != nil {
+		createSpec["user"] = strconv.FormatInt(*security.RunAsUser, 10)
+	}
+	createSpec["privileged"] = security.Privileged
+	createSpec["read_only_filesystem"] = security.ReadonlyRootfs
+
+	if security.Capabilities != nil {
+		if len(security.Capabilities.AddCapabilities) > 0 {
+			createSpec["cap_add"] = security.Capabilities.AddCapabilities
+		}
+		if len(security.Capabilities.DropCapabilities) > 0 {
+			createSpec["cap_drop"] = security.Capabilities.DropCapabilities
+		}
+	}
+
+	if len(security.SupplementalGroups) > 0 {
+		groups := make([]string, len(security.SupplementalGroups))
+		for i, g := range security.SupplementalGroups {
+			groups[i] = strconv.FormatInt(g, 10)
+		}
+		createSpec["groups"] = groups
+	}
+}
+
+func (p *PodmanRuntime) StopProxy(request *api.StopRequest) error {
+	containerID, err := p.findContainerByPodUID(request.PodUID)
+	if err != nil {
+		return err
+	}
+
+	err = p.post(fmt.Sprintf("/libpod/containers/%s/stop", containerID), nil, nil)
+	if err != nil {
+		return err
+	}
+
+	removeVolumeDirs(request.PodUID)
+	globalRegistry.recordStopped(request.PodUID)
+	return nil
+}
+
+func (p *PodmanRuntime) IsReady(request *api.ReadinessRequest) (*ReadinessResult, error) {
+	result, err := checkReadiness(&p.httpClient, request)
+	if err == nil {
+		globalRegistry.recordReadiness(request.PodUID, *result)
+	}
+	return result, err
+}
+
+// DescribeProxy returns the libpod container inspect result and the
+// tail of its logs, for the GET /proxies/{podUID} diagnostics endpoint.
+func (p *PodmanRuntime) DescribeProxy(containerID string, tailLines int) (*api.ContainerStatus, []string, error) {
+	var inspect struct {
+		Image string `json:"Image"`
+		State struct {
+			Status   string `json:"Status"`
+			ExitCode int32  `json:"ExitCode"`
+		} `json:"State"`
+	}
+	if err := p.get(fmt.Sprintf("/libpod/containers/%s/json", containerID), &inspect); err != nil {
+		return nil, nil, err
+	}
+
+	status := &api.ContainerStatus{
+		State:    inspect.State.Status,
+		Image:    inspect.Image,
+		ExitCode: inspect.State.ExitCode,
+	}
+
+	var logs []string
+	resp, err := p.httpClient.Get(fmt.Sprintf("http://podman/%s/libpod/containers/%s/logs?stdout=true&stderr=true&tail=%d", libpodAPIVersion, containerID, tailLines))
+	if err != nil {
+		klog.Warningf("Could not read log tail for container %s: %v", containerID, err)
+	} else {
+		defer resp.Body.Close()
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			logs = append(logs, scanner.Text())
+		}
+	}
+
+	return status, logs, nil
+}
+
+func (p *PodmanRuntime) inspectNamespaces(podSandboxID string) (*podmanNamespaces, error) {
+	var inspect struct {
+		NetworkSettings struct {
+			SandboxKey string `json:"SandboxKey"`
+		} `json:"NetworkSettings"`
+		State struct {
+			Pid int `json:"Pid"`
+		} `json:"State"`
+	}
+
+	err := p.get(fmt.Sprintf("/libpod/containers/%s/json", podSandboxID), &inspect)
+	if err != nil {
+		return nil, err
+	}
+
+	procNS := fmt.Sprintf("/proc/%d/ns", inspect.State.Pid)
+	return &podmanNamespaces{
+		Net: procNS + "/net",
+		IPC: procNS + "/ipc",
+		UTS: procNS + "/uts",
+	}, nil
+}
+
+func (p *PodmanRuntime) findContainerByPodUID(podUID string) (string, error) {
+	var containers []struct {
+		Id     string            `json:"Id"`
+		Labels map[string]string `json:"Labels"`
+	}
+
+	err := p.get("/libpod/containers/json?all=true", &containers)
+	if err != nil {
+		return "", err
+	}
+
+	for _, c := range containers {
+		if c.Labels["io.kubernetes.pod.uid"] == podUID {
+			return c.Id, nil
+		}
+	}
+
+	return "", fmt.Errorf("Could not find sidecar container for pod uid %q", podUID)
+}
+
+func (p *PodmanRuntime) pullImageIfNecessary(image, namespace string, imagePullSecrets []string) error {
+	err := p.get("/libpod/images/"+image+"/json", nil)
+	if err == nil {
+		klog.Info("Image is available locally. No need to pull it.")
+		return nil
+	}
+
+	auth, resolveErr := p.authResolver.resolve(namespace, imagePullSecrets, image)
+	if resolveErr != nil {
+		klog.Infof("No registry credentials resolved for image %s, attempting anonymous pull: %v", image, resolveErr)
+	}
+
+	klog.Infof("Pulling image %s", image)
+	err = p.postWithAuth("/libpod/images/pull?reference="+image, auth)
+	if err != nil && auth == nil && resolveErr != nil {
+		return fmt.Errorf("%v (%v)", err, resolveErr)
+	}
+	return err
+}
+
+// postWithAuth issues a libpod pull request, attaching the registry
+// credentials via the X-Registry-Auth header the Docker/Podman image
+// API expects (a base64-encoded AuthConfig JSON document).
+func (p *PodmanRuntime) postWithAuth(path string, auth *api.AuthConfig) error {
+	req, err := http.NewRequest(http.MethodPost, "http://podman/"+libpodAPIVersion+path, nil)
+	if err != nil {
+		return err
+	}
+	if auth != nil {
+		encoded, err := json.Marshal(auth)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("X-Registry-Auth", base64.StdEncoding.EncodeToString(encoded))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	req = req.WithContext(ctx)
+
+	response, err := p.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= 400 {
+		return fmt.Errorf("podman API request POST %s failed: %s", path, response.Status)
+	}
+	return nil
+}
+
+func (p *PodmanRuntime) get(path string, out interface{}) error {
+	return p.do(http.MethodGet, path, nil, out)
+}
+
+func (p *PodmanRuntime) post(path string, body interface{}, out interface{}) error {
+	return p.do(http.MethodPost, path, body, out)
+}
+
+func (p *PodmanRuntime) do(method, path string, body interface{}, out interface{}) error {
+	var reader *bytes.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+
+	req, err := http.NewRequest(method, "http://podman/"+libpodAPIVersion+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	req = req.WithContext(ctx)
+
+	response, err := p.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= 400 {
+		return fmt.Errorf("podman API request %s %s failed: %s", method, path, response.Status)
+	}
+
+	if out != nil {
+		return json.NewDecoder(response.Body).Decode(out)
+	}
+	return nil
+}
@@ -0,0 +1,356 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"istio.io/cni/pkg/istioproxyagent/api"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
+)
+
+const (
+	defaultReadinessScheme = "http"
+	defaultReadinessHost   = "localhost"
+	defaultReadinessPort   = 15000
+	defaultReadinessPath   = "/server_info"
+
+	backoffInitial = 100 * time.Millisecond
+	backoffFactor  = 2
+	backoffCap     = 2 * time.Second
+	defaultPeriod  = 10 * time.Second
+	defaultTimeout = 1 * time.Second
+)
+
+// ReadinessProbe is the version-neutral, fully-resolved description of
+// how to check whether a sidecar is ready. It's assembled by
+// resolveReadinessProbe from, in priority order: explicit fields on
+// api.ReadinessRequest, the sidecar container's own ReadinessProbe (from
+// the injection spec), and finally the agent's built-in defaults.
+type ReadinessProbe struct {
+	Type       string // "http" or "tcpSocket"
+	Scheme     string
+	Host       string
+	Port       int
+	Path       string
+	Headers    map[string]string
+	StatusMin  int
+	StatusMax  int
+	Timeout    time.Duration
+	Period     time.Duration
+	CABundle   []byte
+	ServerName string
+}
+
+func defaultReadinessProbe() *ReadinessProbe {
+	return &ReadinessProbe{
+		Type:      "http",
+		Scheme:    defaultReadinessScheme,
+		Host:      defaultReadinessHost,
+		Port:      defaultReadinessPort,
+		Path:      defaultReadinessPath,
+		StatusMin: http.StatusOK,
+		StatusMax: http.StatusBadRequest - 1,
+		Timeout:   defaultTimeout,
+		Period:    defaultPeriod,
+	}
+}
+
+// resolveReadinessProbe builds the ReadinessProbe to use for request,
+// layering the sidecar's own ReadinessProbe (if it can be derived from
+// the request's pod/sidecar-template fields) under any fields set
+// explicitly on the request, over the agent's defaults.
+func resolveReadinessProbe(request *api.ReadinessRequest) *ReadinessProbe {
+	probe := defaultReadinessProbe()
+
+	if sidecarProbe := readinessProbeFromSidecar(request); sidecarProbe != nil {
+		probe = sidecarProbe
+	}
+
+	applyExplicitOverrides(probe, request)
+
+	return probe
+}
+
+// readinessProbeFromSidecar re-derives the sidecar container spec via
+// getSidecar (the same injection-template path StartProxy uses) and
+// converts its ReadinessProbe, if any, to our neutral type.
+func readinessProbeFromSidecar(request *api.ReadinessRequest) *ReadinessProbe {
+	if request.PodJSON == "" || request.SidecarTemplate == "" {
+		return nil
+	}
+
+	pod, err := unmarshalPod(request.PodJSON, request.PodIP)
+	if err != nil {
+		klog.Warningf("Could not derive sidecar readiness probe: %v", err)
+		return nil
+	}
+
+	startRequest := &api.StartRequest{
+		PodName:         request.PodName,
+		PodNamespace:    request.PodNamespace,
+		PodUID:          request.PodUID,
+		PodIP:           request.PodIP,
+		SidecarTemplate: request.SidecarTemplate,
+		MeshConfig:      request.MeshConfig,
+	}
+
+	sidecar, err := getSidecar(startRequest, pod)
+	if err != nil {
+		klog.Warningf("Could not derive sidecar readiness probe: %v", err)
+		return nil
+	}
+
+	return convertContainerProbe(sidecar.ReadinessProbe)
+}
+
+func convertContainerProbe(probe *v1.Probe) *ReadinessProbe {
+	if probe == nil {
+		return nil
+	}
+
+	result := defaultReadinessProbe()
+	if probe.PeriodSeconds > 0 {
+		result.Period = time.Duration(probe.PeriodSeconds) * time.Second
+	}
+	if probe.TimeoutSeconds > 0 {
+		result.Timeout = time.Duration(probe.TimeoutSeconds) * time.Second
+	}
+
+	switch {
+	case probe.HTTPGet != nil:
+		result.Type = "http"
+		result.Scheme = schemeOrDefault(string(probe.HTTPGet.Scheme))
+		if probe.HTTPGet.Host != "" {
+			result.Host = probe.HTTPGet.Host
+		}
+		if probe.HTTPGet.Port.IntValue() > 0 {
+			result.Port = probe.HTTPGet.Port.IntValue()
+		}
+		if probe.HTTPGet.Path != "" {
+			result.Path = probe.HTTPGet.Path
+		}
+		if len(probe.HTTPGet.HTTPHeaders) > 0 {
+			result.Headers = map[string]string{}
+			for _, h := range probe.HTTPGet.HTTPHeaders {
+				result.Headers[h.Name] = h.Value
+			}
+		}
+	case probe.TCPSocket != nil:
+		result.Type = "tcpSocket"
+		if probe.TCPSocket.Host != "" {
+			result.Host = probe.TCPSocket.Host
+		}
+		if probe.TCPSocket.Port.IntValue() > 0 {
+			result.Port = probe.TCPSocket.Port.IntValue()
+		}
+	default:
+		return nil
+	}
+
+	return result
+}
+
+// schemeOrDefault lower-cases a v1.URIScheme ("HTTP"/"HTTPS"), falling
+// back to defaultReadinessScheme when it's unset.
+func schemeOrDefault(scheme string) string {
+	if scheme == "" {
+		return defaultReadinessScheme
+	}
+	return strings.ToLower(scheme)
+}
+
+func applyExplicitOverrides(probe *ReadinessProbe, request *api.ReadinessRequest) {
+	if request.ProbeType != "" {
+		probe.Type = request.ProbeType
+	}
+	if request.Scheme != "" {
+		probe.Scheme = request.Scheme
+	}
+	if request.Host != "" {
+		probe.Host = request.Host
+	}
+	if request.Port != 0 {
+		probe.Port = int(request.Port)
+	}
+	if request.Path != "" {
+		probe.Path = request.Path
+	}
+	if len(request.Headers) > 0 {
+		probe.Headers = request.Headers
+	}
+	if request.ExpectedStatusMin != 0 {
+		probe.StatusMin = request.ExpectedStatusMin
+	}
+	if request.ExpectedStatusMax != 0 {
+		probe.StatusMax = request.ExpectedStatusMax
+	}
+	if request.TimeoutSeconds > 0 {
+		probe.Timeout = time.Duration(request.TimeoutSeconds * float64(time.Second))
+	}
+	if request.PeriodSeconds > 0 {
+		probe.Period = time.Duration(request.PeriodSeconds * float64(time.Second))
+	}
+	if len(request.CABundle) > 0 {
+		probe.CABundle = request.CABundle
+	}
+	if request.ServerName != "" {
+		probe.ServerName = request.ServerName
+	}
+}
+
+// checkReadiness enters the pod's network namespace and probes the
+// sidecar, retrying with exponential backoff and jitter until the probe
+// succeeds or its Period budget is exhausted.
+func checkReadiness(httpClient *http.Client, request *api.ReadinessRequest) (*ReadinessResult, error) {
+	probe := resolveReadinessProbe(request)
+	netNS := strings.Replace(request.NetNS, "/proc/", "/hostproc/", 1) // we're running in a container; host's /proc/ is mapped to /hostproc/
+
+	var result *ReadinessResult
+	err := ns.WithNetNSPath(netNS, func(hostNS ns.NetNS) error {
+		result = runProbeWithBackoff(httpClient, probe, request.PodName)
+		return nil
+	})
+
+	return result, err
+}
+
+func runProbeWithBackoff(httpClient *http.Client, probe *ReadinessProbe, podName string) *ReadinessResult {
+	start := time.Now()
+	deadline := start.Add(probe.Period)
+	delay := backoffInitial
+
+	attempts := 0
+	lastStatus := 0
+	for {
+		attempts++
+		ready, status, err := probeOnce(httpClient, probe)
+		lastStatus = status
+
+		if ready {
+			klog.Infof("Readiness probe succeeded for %s after %d attempt(s)", podName, attempts)
+			break
+		}
+		if err != nil {
+			klog.Infof("Readiness probe attempt %d failed for %s: %v", attempts, podName, err)
+		} else {
+			klog.Infof("Readiness probe attempt %d failed for %s: status %d", attempts, podName, status)
+		}
+
+		if time.Now().Add(delay).After(deadline) {
+			break
+		}
+
+		time.Sleep(jitter(delay))
+		delay *= backoffFactor
+		if delay > backoffCap {
+			delay = backoffCap
+		}
+	}
+
+	return &ReadinessResult{
+		Ready:      isLastAttemptReady(lastStatus, probe),
+		Attempts:   attempts,
+		LastStatus: lastStatus,
+		CheckedAt:  start,
+		Latency:    time.Since(start),
+	}
+}
+
+func isLastAttemptReady(lastStatus int, probe *ReadinessProbe) bool {
+	if probe.Type == "tcpSocket" {
+		return lastStatus == 1
+	}
+	return lastStatus >= probe.StatusMin && lastStatus <= probe.StatusMax
+}
+
+// jitter returns a random duration in [d/2, d*3/2), so concurrent
+// readiness checks don't all retry in lockstep.
+func jitter(d time.Duration) time.Duration {
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d)))
+}
+
+// probeOnce issues a single readiness check and returns whether it
+// succeeded and the observed status: an HTTP status code for "http"
+// probes, or 1/0 for a successful/failed "tcpSocket" probe.
+func probeOnce(httpClient *http.Client, probe *ReadinessProbe) (bool, int, error) {
+	if probe.Type == "tcpSocket" {
+		return probeTCP(probe)
+	}
+	return probeHTTP(httpClient, probe)
+}
+
+func probeTCP(probe *ReadinessProbe) (bool, int, error) {
+	addr := net.JoinHostPort(probe.Host, strconv.Itoa(probe.Port))
+	conn, err := net.DialTimeout("tcp", addr, probe.Timeout)
+	if err != nil {
+		return false, 0, err
+	}
+	conn.Close()
+	return true, 1, nil
+}
+
+func probeHTTP(httpClient *http.Client, probe *ReadinessProbe) (bool, int, error) {
+	url := fmt.Sprintf("%s://%s/%s", probe.Scheme, net.JoinHostPort(probe.Host, strconv.Itoa(probe.Port)), trimLeadingSlash(probe.Path))
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return false, 0, err
+	}
+	for k, v := range probe.Headers {
+		req.Header.Set(k, v)
+	}
+
+	client := httpClient
+	if probe.Scheme == "https" {
+		client = httpsClientFor(probe)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), probe.Timeout)
+	defer cancel()
+	req = req.WithContext(ctx)
+
+	response, err := client.Do(req)
+	if err != nil {
+		return false, 0, err
+	}
+	defer response.Body.Close()
+
+	ready := response.StatusCode >= probe.StatusMin && response.StatusCode <= probe.StatusMax
+	return ready, response.StatusCode, nil
+}
+
+func trimLeadingSlash(path string) string {
+	if len(path) > 0 && path[0] == '/' {
+		return path[1:]
+	}
+	return path
+}
+
+// httpsClientFor builds a one-off http.Client for an HTTPS probe,
+// trusting probe.CABundle (if set) and sending probe.ServerName as SNI.
+func httpsClientFor(probe *ReadinessProbe) *http.Client {
+	tlsConfig := &tls.Config{ServerName: probe.ServerName}
+
+	if len(probe.CABundle) > 0 {
+		pool := x509.NewCertPool()
+		if pool.AppendCertsFromPEM(probe.CABundle) {
+			tlsConfig.RootCAs = pool
+		}
+	}
+
+	return &http.Client{
+		Timeout:   probe.Timeout,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}
+}
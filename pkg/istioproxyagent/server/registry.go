@@ -0,0 +1,170 @@
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ProxyState is the lifecycle state of a sidecar the agent knows about.
+type ProxyState string
+
+const (
+	ProxyStateStarting ProxyState = "Starting"
+	ProxyStateRunning  ProxyState = "Running"
+	ProxyStateStopped  ProxyState = "Stopped"
+	ProxyStateFailed   ProxyState = "Failed"
+)
+
+// ReadinessResult is the outcome of the most recent readiness probe for
+// a sidecar: whether it ultimately succeeded, how many attempts the
+// backoff loop took, the status of the last attempt (its HTTP status
+// code for http probes, 0 if that attempt errored before getting a
+// response; 1/0 for a successful/failed tcpSocket probe), and how long
+// the whole probe took.
+type ReadinessResult struct {
+	Ready      bool
+	Attempts   int
+	LastStatus int
+	CheckedAt  time.Time
+	Latency    time.Duration
+}
+
+// ProxyInfo is everything the diagnostics API knows about one sidecar.
+type ProxyInfo struct {
+	PodUID        string
+	PodName       string
+	PodNamespace  string
+	PodSandboxID  string
+	ContainerID   string
+	Image         string
+	State         ProxyState
+	StartedAt     time.Time
+	LastError     string
+	LastReadiness *ReadinessResult
+	VolumeDirs    []string
+}
+
+// proxyRegistry tracks every sidecar the agent has started or attempted
+// to start, and the counters shown on GET /info. It is safe for
+// concurrent use by every ProxyRuntime implementation.
+type proxyRegistry struct {
+	mu      sync.RWMutex
+	proxies map[string]*ProxyInfo
+
+	started int64
+	stopped int64
+	failed  int64
+}
+
+func newProxyRegistry() *proxyRegistry {
+	return &proxyRegistry{proxies: map[string]*ProxyInfo{}}
+}
+
+// globalRegistry is shared by every ProxyRuntime implementation
+// constructed in this process, so the diagnostics API sees sidecars
+// regardless of which backend started them.
+var globalRegistry = newProxyRegistry()
+
+func (r *proxyRegistry) recordStarting(podUID, podName, podNamespace, podSandboxID, image string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.proxies[podUID] = &ProxyInfo{
+		PodUID:       podUID,
+		PodName:      podName,
+		PodNamespace: podNamespace,
+		PodSandboxID: podSandboxID,
+		Image:        image,
+		State:        ProxyStateStarting,
+		StartedAt:    time.Now(),
+	}
+}
+
+func (r *proxyRegistry) recordStarted(podUID, containerID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	atomic.AddInt64(&r.started, 1)
+	if info, ok := r.proxies[podUID]; ok {
+		info.ContainerID = containerID
+		info.State = ProxyStateRunning
+	}
+}
+
+func (r *proxyRegistry) recordFailed(podUID, reason string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	atomic.AddInt64(&r.failed, 1)
+	if info, ok := r.proxies[podUID]; ok {
+		info.State = ProxyStateFailed
+		info.LastError = reason
+	}
+}
+
+func (r *proxyRegistry) recordStopped(podUID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	atomic.AddInt64(&r.stopped, 1)
+	if info, ok := r.proxies[podUID]; ok {
+		info.State = ProxyStateStopped
+	}
+}
+
+// recordVolumeDirs records the node-local directories kube.containerMounts
+// materialized for podUID's emptyDir/secret/configMap volumes, so they can
+// be cleaned up by takeVolumeDirs once the sidecar is stopped.
+func (r *proxyRegistry) recordVolumeDirs(podUID string, dirs []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if info, ok := r.proxies[podUID]; ok {
+		info.VolumeDirs = dirs
+	}
+}
+
+// takeVolumeDirs returns the volume directories recorded for podUID via
+// recordVolumeDirs and clears them, so StopProxy can remove them exactly
+// once.
+func (r *proxyRegistry) takeVolumeDirs(podUID string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	info, ok := r.proxies[podUID]
+	if !ok {
+		return nil
+	}
+	dirs := info.VolumeDirs
+	info.VolumeDirs = nil
+	return dirs
+}
+
+func (r *proxyRegistry) recordReadiness(podUID string, result ReadinessResult) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if info, ok := r.proxies[podUID]; ok {
+		info.LastReadiness = &result
+	}
+}
+
+func (r *proxyRegistry) list() []*ProxyInfo {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	result := make([]*ProxyInfo, 0, len(r.proxies))
+	for _, info := range r.proxies {
+		copied := *info
+		result = append(result, &copied)
+	}
+	return result
+}
+
+func (r *proxyRegistry) get(podUID string) (*ProxyInfo, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	info, ok := r.proxies[podUID]
+	if !ok {
+		return nil, false
+	}
+	copied := *info
+	return &copied, true
+}
+
+func (r *proxyRegistry) counts() (started, stopped, failed int64) {
+	return atomic.LoadInt64(&r.started), atomic.LoadInt64(&r.stopped), atomic.LoadInt64(&r.failed)
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"time"
+
+	"istio.io/cni/pkg/istioproxyagent/api"
+	"k8s.io/klog"
+)
+
+const (
+	defaultPodmanEndpoint = "unix:///run/podman/podman.sock"
+)
+
+var (
+	runtimeBackend  = flag.String("runtime-backend", "auto", "Container runtime backend to use: auto, cri or podman")
+	runtimeEndpoint = flag.String("runtime-endpoint", "", "Endpoint of the container runtime backend. Defaults depend on --runtime-backend")
+)
+
+// ProxyRuntime is implemented by every container-runtime backend the
+// agent knows how to drive in order to start, stop and check the
+// readiness of the istio-proxy sidecar. CRIRuntime and PodmanRuntime are
+// the two implementations.
+type ProxyRuntime interface {
+	StartProxy(request *api.StartRequest) error
+	StopProxy(request *api.StopRequest) error
+	IsReady(request *api.ReadinessRequest) (*ReadinessResult, error)
+
+	// Endpoint returns the runtime socket this backend talks to, for
+	// GET /info.
+	Endpoint() string
+	// APIVersion identifies the runtime dialect in use ("v1"/"v1alpha2"
+	// for CRI, "podman" for Podman), for GET /info.
+	APIVersion() string
+	// DescribeProxy returns the runtime's status for a sidecar
+	// container plus the tail of its logs, for
+	// GET /proxies/{podUID}.
+	DescribeProxy(containerID string, tailLines int) (*api.ContainerStatus, []string, error)
+}
+
+// NewProxyRuntime selects and constructs a ProxyRuntime according to
+// --runtime-backend. With the default "auto" it probes the dockershim
+// and Podman sockets and picks whichever one is present.
+func NewProxyRuntime() (ProxyRuntime, error) {
+	backend := *runtimeBackend
+	if backend == "" || backend == "auto" {
+		var err error
+		backend, err = probeRuntimeBackend()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch backend {
+	case "cri":
+		return NewCRIRuntime(*runtimeEndpoint)
+	case "podman":
+		endpoint := *runtimeEndpoint
+		if endpoint == "" {
+			endpoint = defaultPodmanEndpoint
+		}
+		return NewPodmanRuntime(endpoint)
+	default:
+		return nil, fmt.Errorf("unknown runtime backend %q", backend)
+	}
+}
+
+// probeRuntimeBackend picks a backend by checking which of the known
+// runtime sockets is reachable, preferring CRI (dockershim) for
+// backwards compatibility.
+func probeRuntimeBackend() (string, error) {
+	if socketReachable(getRemoteRuntimeEndpoint()) {
+		klog.Infof("Detected CRI runtime socket at %s", getRemoteRuntimeEndpoint())
+		return "cri", nil
+	}
+	if socketReachable(defaultPodmanEndpoint) {
+		klog.Infof("Detected Podman socket at %s", defaultPodmanEndpoint)
+		return "podman", nil
+	}
+	return "", fmt.Errorf("could not auto-detect a container runtime: no socket found at %s or %s", getRemoteRuntimeEndpoint(), defaultPodmanEndpoint)
+}
+
+func socketReachable(endpoint string) bool {
+	path, err := socketPath(endpoint)
+	if err != nil || path == "" {
+		return false
+	}
+	conn, err := net.DialTimeout("unix", path, 2*time.Second)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
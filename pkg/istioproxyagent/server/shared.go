@@ -0,0 +1,81 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/klog"
+)
+
+// newInClusterKubeClient builds the kube client used to read
+// imagePullSecrets and EnvFrom sources, picking up its credentials from
+// the in-cluster service account. Callers treat a failure here as
+// non-fatal: without it the agent still starts and falls back to the
+// node's docker config files for anonymous/public image pulls.
+func newInClusterKubeClient() (kubernetes.Interface, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, fmt.Errorf("Could not build in-cluster kube config: %v", err)
+	}
+	return kubernetes.NewForConfig(config)
+}
+
+// unmarshalPod decodes the pod manifest carried in a StartRequest and
+// fills in the pod IP, which isn't set yet when the webhook captured the
+// manifest. It's shared by every ProxyRuntime implementation, since they
+// all need the pod spec to resolve the sidecar container via getSidecar.
+func unmarshalPod(podJSON, podIP string) (v1.Pod, error) {
+	pod := v1.Pod{}
+	err := json.Unmarshal([]byte(podJSON), &pod)
+	if err != nil {
+		return pod, fmt.Errorf("Could not unmarshal pod YAML: %v", err)
+	}
+	pod.Status.PodIP = podIP // we set it, because it's not set in the YAML yet
+	return pod, nil
+}
+
+// removeVolumeDirs deletes the node-local directories kube.containerMounts
+// materialized for podUID's emptyDir/secret/configMap volumes (tracked via
+// globalRegistry.recordVolumeDirs when the sidecar was started). It's
+// shared by every ProxyRuntime implementation's StopProxy, since none of
+// them ever went through kubelet's own volume manager to have this
+// cleaned up for them. A directory that fails to remove is logged and
+// otherwise ignored, since it shouldn't block the sidecar from being
+// reported as stopped.
+func removeVolumeDirs(podUID string) {
+	for _, dir := range globalRegistry.takeVolumeDirs(podUID) {
+		if err := os.RemoveAll(dir); err != nil {
+			klog.Warningf("Could not remove materialized volume directory %s for pod %s: %v", dir, podUID, err)
+		}
+	}
+}
+
+// tailFile returns the last n lines of the file at path. It's used to
+// surface a sidecar's recent stdout/stderr in the diagnostics API
+// without shelling out to the node.
+func tailFile(path string, n int) ([]string, error) {
+	if path == "" {
+		return nil, fmt.Errorf("no log path available")
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+		if len(lines) > n {
+			lines = lines[1:]
+		}
+	}
+	return lines, scanner.Err()
+}